@@ -0,0 +1,836 @@
+package plg
+
+import (
+	"math"
+	"math/big"
+	"math/bits"
+)
+
+/*
+	Arithmetic evaluation: eval
+
+	An arithmetic expression is evaluated by is/2 to a number. An evaluable
+	functor is looked up by its name in the table of its arity, and applied to
+	its evaluated arguments, which are numbers, so the functions raise errors
+	by panics directly.
+
+	Most functions are defined by a fn1 or fn2, with an implementation for each
+	kind of numbers, i.e. integers, big integers, rationals and floats.
+	Arguments are converted to the widest kind of them. An integer result which
+	overflows is computed again on big integers, so small integers stay fast.
+	Rational results are normalized, i.e. an integral one is an integer.
+
+	Errors:
+	  an unbound variable       instantiation_error
+	  not an evaluable functor  type_error(evaluable, Name/Arity)
+	  a float for an integer    type_error(integer, Float)
+	  a float for a rational    type_error(rational, Float)
+	  dividing by zero          evaluation_error(zero_divisor)
+	  an undefined result       evaluation_error(undefined), e.g. sqrt(-1)
+	  a too large float         evaluation_error(float_overflow)
+	  a too large integer       evaluation_error(int_overflow), e.g. 2 << 2 ** 70
+*/
+
+var (
+	// constants, e.g. pi
+	gEval0 = make(map[atom]func() Term)
+	// unary functions, e.g. abs
+	gEval1 = make(map[atom]func(x Term) Term)
+	// binary functions, e.g. +
+	gEval2 = make(map[atom]func(x, y Term) Term)
+
+	// Op of a *buildin2 -> its functor
+	opFunctors = make(map[int]atom)
+)
+
+// Kinds of numbers, from the narrowest to the widest.
+const (
+	nkInt   = iota // Integer
+	nkBig          // BigInt
+	nkRat          // Rational
+	nkFloat        // Float
+)
+
+func numKind(x Term) int {
+	switch x.(type) {
+	case Integer:
+		return nkInt
+	case BigInt:
+		return nkBig
+	case Rational:
+		return nkRat
+	}
+	return nkFloat
+}
+
+// fn1 is a unary function implemented on kinds of numbers. An argument is
+// converted to the narrowest wider kind implemented, but floats are never
+// converted to integers.
+type fn1 struct {
+	name string
+	// ok is false if the result overflows
+	i func(x Integer) (r Term, ok bool)
+	b func(x *big.Int) Term
+	r func(x *big.Rat) Term
+	f func(x float64) float64
+}
+
+func (fn fn1) eval(x Term) Term {
+	switch x := x.(type) {
+	case Integer:
+		if fn.i != nil {
+			if r, ok := fn.i(x); ok {
+				return r
+			}
+		}
+		if fn.b != nil {
+			return fn.b(big.NewInt(int64(x)))
+		}
+	case BigInt:
+		if fn.b != nil {
+			return fn.b(x.i)
+		}
+	case Rational:
+		if fn.r != nil {
+			return fn.r(x.r)
+		}
+	}
+
+	if fn.f == nil {
+		panic(typeError("integer", x, indicator(A(fn.name), 1)))
+	}
+	return floatResult(fn.f(toFloat(x)), fn.name, 1)
+}
+
+// fn2 is a binary function implemented on kinds of numbers. The arguments are
+// converted in the same way as fn1.
+type fn2 struct {
+	name string
+	// ok is false if the result overflows
+	i func(x, y Integer) (r Term, ok bool)
+	b func(x, y *big.Int) Term
+	r func(x, y *big.Rat) Term
+	f func(x, y float64) float64
+}
+
+func (fn fn2) eval(x, y Term) Term {
+	kind := max(numKind(x), numKind(y))
+	if kind == nkInt && fn.i != nil {
+		if r, ok := fn.i(x.(Integer), y.(Integer)); ok {
+			return r
+		}
+	}
+	if kind <= nkBig && fn.b != nil {
+		return fn.b(toBig(x), toBig(y))
+	}
+	if kind <= nkRat && fn.r != nil {
+		return fn.r(toRat(x), toRat(y))
+	}
+
+	if fn.f == nil {
+		if numKind(x) >= nkRat {
+			panic(typeError("integer", x, indicator(A(fn.name), 2)))
+		}
+		panic(typeError("integer", y, indicator(A(fn.name), 2)))
+	}
+	return floatResult(fn.f(toFloat(x), toFloat(y)), fn.name, 2)
+}
+
+func def1(fn fn1) {
+	gEval1[A(fn.name)] = fn.eval
+}
+
+func def2(fn fn2) {
+	gEval2[A(fn.name)] = fn.eval
+}
+
+func init() {
+	for op, name := range OpNames {
+		opFunctors[op] = A(name)
+	}
+
+	gEval0[A("pi")] = func() Term { return Float(math.Pi) }
+	gEval0[A("e")] = func() Term { return Float(math.E) }
+	gEval0[A("epsilon")] = func() Term { return Float(math.Nextafter(1, 2) - 1) }
+
+	/* all numbers */
+
+	def1(fn1{name: "-",
+		i: func(x Integer) (Term, bool) { return -x, x != math.MinInt },
+		b: func(x *big.Int) Term { return Big(new(big.Int).Neg(x)) },
+		r: func(x *big.Rat) Term { return Rat(new(big.Rat).Neg(x)) },
+		f: func(x float64) float64 { return -x }})
+	def1(fn1{name: "+",
+		i: func(x Integer) (Term, bool) { return x, true },
+		b: func(x *big.Int) Term { return BigInt{i: x} },
+		r: func(x *big.Rat) Term { return Rational{r: x} },
+		f: func(x float64) float64 { return x }})
+	def1(fn1{name: "abs",
+		i: func(x Integer) (Term, bool) {
+			if x < 0 {
+				return -x, x != math.MinInt
+			}
+			return x, true
+		},
+		b: func(x *big.Int) Term { return Big(new(big.Int).Abs(x)) },
+		r: func(x *big.Rat) Term { return Rat(new(big.Rat).Abs(x)) },
+		f: math.Abs})
+	def1(fn1{name: "sign",
+		i: func(x Integer) (Term, bool) {
+			switch {
+			case x > 0:
+				return Integer(1), true
+			case x < 0:
+				return Integer(-1), true
+			}
+			return Integer(0), true
+		},
+		b: func(x *big.Int) Term { return Integer(x.Sign()) },
+		r: func(x *big.Rat) Term { return Integer(x.Sign()) },
+		f: func(x float64) float64 {
+			switch {
+			case x > 0:
+				return 1
+			case x < 0:
+				return -1
+			}
+			return 0
+		}})
+
+	def2(fn2{name: "+",
+		i: func(x, y Integer) (Term, bool) {
+			r := x + y
+			return r, (x^r)&(y^r) >= 0
+		},
+		b: func(x, y *big.Int) Term { return Big(new(big.Int).Add(x, y)) },
+		r: func(x, y *big.Rat) Term { return Rat(new(big.Rat).Add(x, y)) },
+		f: func(x, y float64) float64 { return x + y }})
+	def2(fn2{name: "-",
+		i: func(x, y Integer) (Term, bool) {
+			r := x - y
+			return r, (x^y)&(x^r) >= 0
+		},
+		b: func(x, y *big.Int) Term { return Big(new(big.Int).Sub(x, y)) },
+		r: func(x, y *big.Rat) Term { return Rat(new(big.Rat).Sub(x, y)) },
+		f: func(x, y float64) float64 { return x - y }})
+	def2(fn2{name: "*",
+		i: mulInt,
+		b: func(x, y *big.Int) Term { return Big(new(big.Int).Mul(x, y)) },
+		r: func(x, y *big.Rat) Term { return Rat(new(big.Rat).Mul(x, y)) },
+		f: func(x, y float64) float64 { return x * y }})
+	// an integer if exact, a float otherwise, or a rational for rationals
+	def2(fn2{name: "/",
+		i: func(x, y Integer) (Term, bool) {
+			if y == 0 {
+				zeroDivisor("/")
+			}
+			if x%y != 0 {
+				return Float(float64(x) / float64(y)), true
+			}
+			return x / y, y != -1 || x != math.MinInt
+		},
+		b: func(x, y *big.Int) Term {
+			if y.Sign() == 0 {
+				zeroDivisor("/")
+			}
+			q, r := new(big.Int).QuoRem(x, y, new(big.Int))
+			if r.Sign() != 0 {
+				f, _ := new(big.Rat).SetFrac(x, y).Float64()
+				return floatResult(f, "/", 2)
+			}
+			return Big(q)
+		},
+		r: func(x, y *big.Rat) Term {
+			if y.Sign() == 0 {
+				zeroDivisor("/")
+			}
+			return Rat(new(big.Rat).Quo(x, y))
+		},
+		f: func(x, y float64) float64 {
+			if y == 0 {
+				zeroDivisor("/")
+			}
+			return x / y
+		}})
+	gEval2[A("min")] = func(x, y Term) Term {
+		if compareNum(y, x) < 0 {
+			return y
+		}
+		return x
+	}
+	gEval2[A("max")] = func(x, y Term) Term {
+		if compareNum(y, x) > 0 {
+			return y
+		}
+		return x
+	}
+	// an integer for integers, unless the exponent is negative, or a rational
+	// for a rational to the power of an integer
+	def2(fn2{name: "**",
+		i: func(x, y Integer) (Term, bool) {
+			if y < 0 {
+				return floatPow("**", float64(x), float64(y)), true
+			}
+			return intPow("**", x, y)
+		},
+		b: func(x, y *big.Int) Term {
+			if y.Sign() < 0 {
+				return floatPow("**", toFloat(Big(x)), toFloat(Big(y)))
+			}
+			return bigPow("**", x, y)
+		},
+		r: func(x, y *big.Rat) Term { return ratPow("**", x, y) },
+		f: func(x, y float64) float64 { return float64(floatPow("**", x, y)) }})
+	// an integer for integers, or a rational for a rational to the power of an
+	// integer
+	def2(fn2{name: "^",
+		i: func(x, y Integer) (Term, bool) { return intPow("^", x, y) },
+		b: func(x, y *big.Int) Term { return bigPow("^", x, y) },
+		r: func(x, y *big.Rat) Term { return ratPow("^", x, y) },
+		f: func(x, y float64) float64 { return float64(floatPow("^", x, y)) }})
+
+	/* integers only */
+
+	def1(fn1{name: "\\",
+		i: func(x Integer) (Term, bool) { return ^x, true },
+		b: func(x *big.Int) Term { return Big(new(big.Int).Not(x)) }})
+	def1(fn1{name: "msb",
+		b: func(x *big.Int) Term {
+			if x.Sign() <= 0 {
+				panic(typeError("not_less_than_one", Big(x), indicator(A("msb"), 1)))
+			}
+			return Integer(x.BitLen() - 1)
+		},
+		i: func(x Integer) (Term, bool) {
+			if x <= 0 {
+				panic(typeError("not_less_than_one", x, indicator(A("msb"), 1)))
+			}
+			return Integer(bits.Len(uint(x)) - 1), true
+		}})
+
+	// truncating
+	def2(fn2{name: "//",
+		i: func(x, y Integer) (Term, bool) {
+			if y == 0 {
+				zeroDivisor("//")
+			}
+			return x / y, y != -1 || x != math.MinInt
+		},
+		b: func(x, y *big.Int) Term {
+			if y.Sign() == 0 {
+				zeroDivisor("//")
+			}
+			return Big(new(big.Int).Quo(x, y))
+		}})
+	def2(fn2{name: "rem",
+		i: func(x, y Integer) (Term, bool) {
+			if y == 0 {
+				zeroDivisor("rem")
+			}
+			return x % y, true
+		},
+		b: func(x, y *big.Int) Term {
+			if y.Sign() == 0 {
+				zeroDivisor("rem")
+			}
+			return Big(new(big.Int).Rem(x, y))
+		}})
+	// with the sign of y
+	def2(fn2{name: "mod",
+		i: func(x, y Integer) (Term, bool) {
+			if y == 0 {
+				zeroDivisor("mod")
+			}
+			m := x % y
+			if m != 0 && (m < 0) != (y < 0) {
+				m += y
+			}
+			return m, true
+		},
+		b: func(x, y *big.Int) Term {
+			if y.Sign() == 0 {
+				zeroDivisor("mod")
+			}
+			m := new(big.Int).Rem(x, y)
+			if m.Sign() != 0 && m.Sign() != y.Sign() {
+				m.Add(m, y)
+			}
+			return Big(m)
+		}})
+	// flooring
+	def2(fn2{name: "div",
+		i: func(x, y Integer) (Term, bool) {
+			if y == 0 {
+				zeroDivisor("div")
+			}
+			q := x / y
+			if x%y != 0 && (x < 0) != (y < 0) {
+				q--
+			}
+			return q, y != -1 || x != math.MinInt
+		},
+		b: func(x, y *big.Int) Term {
+			if y.Sign() == 0 {
+				zeroDivisor("div")
+			}
+			q, m := new(big.Int).QuoRem(x, y, new(big.Int))
+			if m.Sign() != 0 && m.Sign() != y.Sign() {
+				q.Sub(q, big.NewInt(1))
+			}
+			return Big(q)
+		}})
+	def2(fn2{name: "<<",
+		i: shiftLeft,
+		b: bigShiftLeft})
+	def2(fn2{name: ">>",
+		i: func(x, y Integer) (Term, bool) {
+			return shiftLeft(x, -y)
+		},
+		b: func(x, y *big.Int) Term {
+			return bigShiftLeft(x, new(big.Int).Neg(y))
+		}})
+	def2(fn2{name: "/\\",
+		i: func(x, y Integer) (Term, bool) { return x & y, true },
+		b: func(x, y *big.Int) Term { return Big(new(big.Int).And(x, y)) }})
+	def2(fn2{name: "\\/",
+		i: func(x, y Integer) (Term, bool) { return x | y, true },
+		b: func(x, y *big.Int) Term { return Big(new(big.Int).Or(x, y)) }})
+	def2(fn2{name: "xor",
+		i: func(x, y Integer) (Term, bool) { return x ^ y, true },
+		b: func(x, y *big.Int) Term { return Big(new(big.Int).Xor(x, y)) }})
+	def2(fn2{name: "gcd",
+		i: func(x, y Integer) (Term, bool) {
+			for y != 0 {
+				x, y = y, x%y
+			}
+			if x < 0 {
+				return -x, x != math.MinInt
+			}
+			return x, true
+		},
+		b: func(x, y *big.Int) Term {
+			return Big(new(big.Int).GCD(nil, nil, x, y))
+		}})
+
+	/* floats */
+
+	for name, f := range map[string]func(x float64) float64{
+		"sqrt": math.Sqrt,
+		"sin":  math.Sin,
+		"cos":  math.Cos,
+		"tan":  math.Tan,
+		"asin": math.Asin,
+		"acos": math.Acos,
+		"atan": math.Atan,
+		"exp":  math.Exp,
+		"log": func(x float64) float64 {
+			if x <= 0 {
+				panic(evaluationError("undefined", indicator(A("log"), 1)))
+			}
+			return math.Log(x)
+		},
+		"float":                 func(x float64) float64 { return x },
+		"float_integer_part":    math.Trunc,
+		"float_fractional_part": func(x float64) float64 { return x - math.Trunc(x) },
+	} {
+		def1(fn1{name: name, f: f})
+	}
+
+	def2(fn2{name: "atan2", f: math.Atan2})
+	def2(fn2{name: "atan", f: math.Atan2})
+	def2(fn2{name: "log", f: func(b, x float64) float64 {
+		if b <= 0 || x <= 0 {
+			panic(evaluationError("undefined", indicator(A("log"), 2)))
+		}
+		return math.Log(x) / math.Log(b)
+	}})
+
+	/* rationals */
+
+	gEval1[A("rational")] = func(x Term) Term {
+		if f, ok := x.(Float); ok {
+			return Rat(new(big.Rat).SetFloat64(float64(f)))
+		}
+		return x
+	}
+	gEval1[A("rationalize")] = func(x Term) Term {
+		if f, ok := x.(Float); ok {
+			return Rat(rationalize(float64(f)))
+		}
+		return x
+	}
+	gEval1[A("numerator")] = func(x Term) Term {
+		return Big(toRatArg("numerator", 1, x).Num())
+	}
+	gEval1[A("denominator")] = func(x Term) Term {
+		return Big(toRatArg("denominator", 1, x).Denom())
+	}
+	gEval2[A("rdiv")] = func(x, y Term) Term {
+		xr, yr := toRatArg("rdiv", 2, x), toRatArg("rdiv", 2, y)
+		if yr.Sign() == 0 {
+			zeroDivisor("rdiv")
+		}
+		return Rat(new(big.Rat).Quo(xr, yr))
+	}
+
+	/* to integers */
+
+	for name, f := range map[string]struct {
+		f func(x float64) float64
+		r func(x *big.Rat) *big.Int
+	}{
+		"floor":    {math.Floor, ratFloor},
+		"ceiling":  {math.Ceil, ratCeiling},
+		"round":    {math.Round, ratRound},
+		"truncate": {math.Trunc, ratTruncate},
+		"integer":  {math.Round, ratRound},
+	} {
+		gEval1[A(name)] = roundFn(f.f, f.r)
+	}
+}
+
+// eval evaluates the arithmetic expression t, with current bindings in bds,
+// to a number.
+func eval(t Term, bds *Bindings) Term {
+	switch t := bds.unifyVar(t).(type) {
+	case Integer:
+		return t
+
+	case Float:
+		return t
+
+	case BigInt:
+		return t
+
+	case Rational:
+		return t
+
+	case variable:
+		throwError(instantiationError(nil), bds)
+
+	case atom:
+		if f := gEval0[t]; f != nil {
+			return f()
+		}
+		throwError(typeError("evaluable", indicator(t, 0), nil), bds)
+
+	case *buildin2:
+		return evalFn2(opFunctors[t.Op], t.L, t.R, bds)
+
+	case *ComplexTerm:
+		switch len(t.Args) {
+		case 1:
+			if f := gEval1[t.Functor]; f != nil {
+				return f(eval(t.Args[0], bds))
+			}
+		case 2:
+			return evalFn2(t.Functor, t.Args[0], t.Args[1], bds)
+		}
+		throwError(typeError("evaluable", indicator(t.Functor, len(t.Args)),
+			nil), bds)
+
+	default:
+		throwError(typeError("evaluable", t, nil), bds)
+	}
+	return nil
+}
+
+func evalFn2(name atom, x, y Term, bds *Bindings) Term {
+	f := gEval2[name]
+	if f == nil {
+		throwError(typeError("evaluable", indicator(name, 2), nil), bds)
+	}
+	return f(eval(x, bds), eval(y, bds))
+}
+
+// compareNum compares the numbers x and y. Returns -1 if x < y, 0 if x == y,
+// and 1 if x > y. An integer is converted to a float when compared with a
+// float.
+func compareNum(x, y Term) int {
+	switch max(numKind(x), numKind(y)) {
+	case nkInt:
+		xi, yi := x.(Integer), y.(Integer)
+		switch {
+		case xi < yi:
+			return -1
+		case xi > yi:
+			return 1
+		}
+		return 0
+
+	case nkBig:
+		return toBig(x).Cmp(toBig(y))
+
+	case nkRat:
+		return toRat(x).Cmp(toRat(y))
+	}
+
+	xf, yf := toFloat(x), toFloat(y)
+	switch {
+	case xf < yf:
+		return -1
+	case xf > yf:
+		return 1
+	}
+	return 0
+}
+
+// toFloat converts the number x to a float64, which is infinite if x is a too
+// large integer.
+func toFloat(x Term) float64 {
+	switch x := x.(type) {
+	case Integer:
+		return float64(x)
+	case BigInt:
+		f, _ := new(big.Float).SetInt(x.i).Float64()
+		return f
+	case Rational:
+		f, _ := x.r.Float64()
+		return f
+	}
+	return float64(x.(Float))
+}
+
+// toBig converts the integer x to a *big.Int, which should not be modified.
+func toBig(x Term) *big.Int {
+	if i, ok := x.(Integer); ok {
+		return big.NewInt(int64(i))
+	}
+	return x.(BigInt).i
+}
+
+// toRat converts the integer or rational x to a *big.Rat, which should not be
+// modified.
+func toRat(x Term) *big.Rat {
+	switch x := x.(type) {
+	case Integer:
+		return new(big.Rat).SetInt64(int64(x))
+	case BigInt:
+		return new(big.Rat).SetInt(x.i)
+	}
+	return x.(Rational).r
+}
+
+// toRatArg is toRat for an argument of the function name/arity, which raises
+// type_error(rational, x) for a float.
+func toRatArg(name string, arity int, x Term) *big.Rat {
+	if numKind(x) == nkFloat {
+		panic(typeError("rational", x, indicator(A(name), arity)))
+	}
+	return toRat(x)
+}
+
+// floatResult returns r as a Float, or raises an evaluation error if r is not
+// finite. name/arity is the function evaluated.
+func floatResult(r float64, name string, arity int) Float {
+	switch {
+	case math.IsNaN(r):
+		panic(evaluationError("undefined", indicator(A(name), arity)))
+	case math.IsInf(r, 0):
+		panic(evaluationError("float_overflow", indicator(A(name), arity)))
+	}
+	return Float(r)
+}
+
+// roundFn returns a unary function, which rounds a float to an integer by f,
+// or a rational by r. An integer is returned as it is.
+func roundFn(f func(x float64) float64, r func(x *big.Rat) *big.Int) func(x Term) Term {
+	return func(x Term) Term {
+		switch x := x.(type) {
+		case Integer, BigInt:
+			return x
+		case Rational:
+			return Big(r(x.r))
+		}
+		r := f(toFloat(x))
+		if r >= math.MinInt && r < math.MaxInt {
+			return Integer(r)
+		}
+		i, _ := big.NewFloat(r).Int(nil)
+		return Big(i)
+	}
+}
+
+func ratFloor(x *big.Rat) *big.Int {
+	// Euclidean division is flooring for the positive denominator
+	return new(big.Int).Div(x.Num(), x.Denom())
+}
+
+func ratCeiling(x *big.Rat) *big.Int {
+	q := ratFloor(new(big.Rat).Neg(x))
+	return q.Neg(q)
+}
+
+func ratTruncate(x *big.Rat) *big.Int {
+	return new(big.Int).Quo(x.Num(), x.Denom())
+}
+
+// ratRound rounds x to the nearest integer, and half away from zero.
+func ratRound(x *big.Rat) *big.Int {
+	q := ratFloor(new(big.Rat).Add(new(big.Rat).Abs(x), big.NewRat(1, 2)))
+	if x.Sign() < 0 {
+		q.Neg(q)
+	}
+	return q
+}
+
+// rationalize returns a rational with a small denominator, which converts to
+// the same float as f, by the convergents of the continued fraction of f.
+func rationalize(f float64) *big.Rat {
+	p0, q0 := big.NewInt(0), big.NewInt(1)
+	p1, q1 := big.NewInt(1), big.NewInt(0)
+	for e := f; ; {
+		a := math.Floor(e)
+		ai, _ := big.NewFloat(a).Int(nil)
+		p0, p1 = p1, new(big.Int).Add(new(big.Int).Mul(ai, p1), p0)
+		q0, q1 = q1, new(big.Int).Add(new(big.Int).Mul(ai, q1), q0)
+
+		r := new(big.Rat).SetFrac(p1, q1)
+		if rf, _ := r.Float64(); rf == f || e == a {
+			return r
+		}
+		if e = 1 / (e - a); math.IsInf(e, 0) {
+			return r
+		}
+	}
+}
+
+// zeroDivisor raises evaluation_error(zero_divisor) of the binary function
+// name.
+func zeroDivisor(name string) {
+	panic(evaluationError("zero_divisor", indicator(A(name), 2)))
+}
+
+func mulInt(x, y Integer) (Term, bool) {
+	if x == 0 || y == 0 {
+		return Integer(0), true
+	}
+	r := x * y
+	if r/y != x || x == -1 && y == math.MinInt || y == -1 && x == math.MinInt {
+		return nil, false
+	}
+	return r, true
+}
+
+// intPow returns x to the power of y. A negative y is only allowed when x is
+// 1 or -1, as the result is not an integer otherwise.
+func intPow(name string, x, y Integer) (Term, bool) {
+	if y < 0 {
+		return negPow(name, x, y%2 == 0), true
+	}
+
+	res := Term(Integer(1))
+	for ; y > 0; y >>= 1 {
+		var ok bool
+		if y&1 != 0 {
+			if res, ok = mulInt(res.(Integer), x); !ok {
+				return nil, false
+			}
+		}
+		if y > 1 {
+			sq, ok := mulInt(x, x)
+			if !ok {
+				return nil, false
+			}
+			x = sq.(Integer)
+		}
+	}
+	return res, true
+}
+
+func bigPow(name string, x, y *big.Int) Term {
+	if y.Sign() < 0 {
+		return negPow(name, Big(x), y.Bit(0) == 0)
+	}
+	if x.CmpAbs(big.NewInt(1)) > 0 && !y.IsInt64() {
+		panic(evaluationError("int_overflow", indicator(A(name), 2)))
+	}
+	return Big(new(big.Int).Exp(x, y, nil))
+}
+
+// ratPow returns x to the power of y. The result is exact if y is an integer,
+// and a float otherwise.
+func ratPow(name string, x, y *big.Rat) Term {
+	if !y.IsInt() {
+		xf, _ := x.Float64()
+		yf, _ := y.Float64()
+		return floatPow(name, xf, yf)
+	}
+
+	n := y.Num()
+	if n.Sign() < 0 {
+		if x.Sign() == 0 {
+			zeroDivisor(name)
+		}
+		x, n = new(big.Rat).Inv(x), new(big.Int).Neg(n)
+	}
+	if !n.IsInt64() {
+		panic(evaluationError("int_overflow", indicator(A(name), 2)))
+	}
+	num := new(big.Int).Exp(x.Num(), n, nil)
+	den := new(big.Int).Exp(x.Denom(), n, nil)
+	return Rat(new(big.Rat).SetFrac(num, den))
+}
+
+// negPow returns x to the power of a negative integer, whose parity is even.
+func negPow(name string, x Term, even bool) Term {
+	switch x {
+	case Integer(1):
+		return x
+	case Integer(-1):
+		if even {
+			return Integer(1)
+		}
+		return x
+	case Integer(0):
+		zeroDivisor(name)
+	}
+	panic(typeError("float", x, indicator(A(name), 2)))
+}
+
+// floatPow returns x to the power of y as a float.
+func floatPow(name string, x, y float64) Float {
+	if x == 0 && y < 0 {
+		zeroDivisor(name)
+	}
+	return floatResult(math.Pow(x, y), name, 2)
+}
+
+// shiftLeft returns x << n, which is x >> -n for a negative n.
+func shiftLeft(x, n Integer) (Term, bool) {
+	switch {
+	case n == math.MinInt:
+		// -n overflows
+		return nil, false
+	case n <= -bits.UintSize:
+		if x < 0 {
+			return Integer(-1), true
+		}
+		return Integer(0), true
+	case n < 0:
+		return x >> uint(-n), true
+	case n >= bits.UintSize:
+		return Integer(0), x == 0
+	}
+
+	r := x << uint(n)
+	return r, r>>uint(n) == x
+}
+
+func bigShiftLeft(x, n *big.Int) Term {
+	switch {
+	case n.IsInt64() && n.Int64() >= 0 && n.Int64() <= math.MaxInt32:
+		return Big(new(big.Int).Lsh(x, uint(n.Int64())))
+	case n.IsInt64() && n.Int64() < 0 && n.Int64() >= -math.MaxInt32:
+		return Big(new(big.Int).Rsh(x, uint(-n.Int64())))
+	case n.Sign() < 0:
+		// shifted out
+		if x.Sign() < 0 {
+			return Integer(-1)
+		}
+		return Integer(0)
+	case x.Sign() == 0:
+		return Integer(0)
+	}
+	panic(evaluationError("int_overflow", indicator(A("<<"), 2)))
+}
@@ -0,0 +1,73 @@
+package plg
+
+/*
+	Atom table: atomTable
+
+	Each Machine owns an atom table of the atoms in its clauses. An atom is
+	interned when a clause referencing it is added, so the same atom in many
+	clauses is kept once, and it is released when no clause references it.
+
+	Atoms of queries, e.g. those made by concatenating FirstLeft, are not in
+	any table, and are released with the terms referencing them. Variables of
+	clauses are renamed to r-variables, so a Machine keeps no variable names,
+	and the named variables of a query are collected by the query itself.
+*/
+
+type atomEntry struct {
+	// the interned atom
+	at atom
+	// number of references by clauses
+	refs int
+}
+
+// atomTable is guarded by the lock of its Machine.
+type atomTable map[atom]*atomEntry
+
+// intern returns the atom in tbl equal to at, which is added if not found, and
+// counts a reference to it.
+func (tbl atomTable) intern(at atom) atom {
+	e := tbl[at]
+	if e == nil {
+		e = &atomEntry{at: at}
+		tbl[at] = e
+	}
+	e.refs++
+	return e.at
+}
+
+// release drops a reference to each of ats, and removes the atoms no longer
+// referenced.
+func (tbl atomTable) release(ats []atom) {
+	for _, at := range ats {
+		if e := tbl[at]; e != nil {
+			if e.refs--; e.refs == 0 {
+				delete(tbl, at)
+			}
+		}
+	}
+}
+
+/* clauseVars: renames variables as rVarBindings, and interns atoms */
+
+type clauseVars struct {
+	rVarBindings
+	atoms atomTable
+	// the distinct atoms of the clause, each interned once, released when the
+	// clause is removed
+	interned []atom
+	// the atoms in interned -> the interned ones
+	seen map[atom]atom
+}
+
+func (cv *clauseVars) atom(at atom) atom {
+	if in, ok := cv.seen[at]; ok {
+		return in
+	}
+	if cv.seen == nil {
+		cv.seen = make(map[atom]atom)
+	}
+	in := cv.atoms.intern(at)
+	cv.seen[at] = in
+	cv.interned = append(cv.interned, in)
+	return in
+}
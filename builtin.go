@@ -0,0 +1,509 @@
+package plg
+
+import (
+	"context"
+)
+
+/*
+	Builtin predicates: *builtinPred
+
+	A call of a builtin predicate is proved by Go code instead of clauses. A
+	deterministic one has at most one solution. A nondeterministic one returns
+	the alternatives of a call, which are tried in order like clauses.
+*/
+
+type builtinPred struct {
+	// proves a call with args, returns false for failure
+	det func(m *Machine, args []Term, bds *Bindings) bool
+	// like det, for a builtin proving goals in ctx of the running query, e.g.
+	// predsort/3
+	detCtx func(ctx context.Context, m *Machine, args []Term, bds *Bindings) bool
+	// returns the alternatives of a call with args, each of which puts the
+	// bindings of a solution into bds, and returns false for failure
+	nondet func(m *Machine, args []Term, bds *Bindings) []func() bool
+}
+
+// Key() of the call -> the builtin predicate
+var gBuiltins = make(map[predKey]*builtinPred)
+
+func init() {
+	gBuiltins[keyOf("assert", 1)] = &builtinPred{det: biAssertz}
+	gBuiltins[keyOf("assertz", 1)] = &builtinPred{det: biAssertz}
+	gBuiltins[keyOf("asserta", 1)] = &builtinPred{det: biAsserta}
+	gBuiltins[keyOf("retract", 1)] = &builtinPred{nondet: biRetract}
+	gBuiltins[keyOf("retractall", 1)] = &builtinPred{det: biRetractall}
+	gBuiltins[keyOf("abolish", 1)] = &builtinPred{det: biAbolish}
+	gBuiltins[keyOf("dynamic", 1)] = &builtinPred{det: biDynamic}
+
+	gBuiltins[keyOf("set_prolog_flag", 2)] = &builtinPred{det: biSetPrologFlag}
+	gBuiltins[keyOf("current_prolog_flag", 2)] = &builtinPred{det: biCurrentPrologFlag}
+
+	for name, ok := range map[string]func(c int) bool{
+		"==":   func(c int) bool { return c == 0 },
+		"\\==": func(c int) bool { return c != 0 },
+		"@<":   func(c int) bool { return c < 0 },
+		"@>":   func(c int) bool { return c > 0 },
+		"@=<":  func(c int) bool { return c <= 0 },
+		"@>=":  func(c int) bool { return c >= 0 },
+	} {
+		gBuiltins[keyOf(name, 2)] = &builtinPred{
+			det: func(m *Machine, args []Term, bds *Bindings) bool {
+				return ok(compareTerms(args[0], args[1], bds))
+			}}
+	}
+	gBuiltins[keyOf("compare", 3)] = &builtinPred{det: biCompare}
+
+	gBuiltins[keyOf("msort", 2)] = &builtinPred{det: biMsort}
+	gBuiltins[keyOf("sort", 2)] = &builtinPred{det: biSort}
+	gBuiltins[keyOf("sort", 4)] = &builtinPred{det: biSort4}
+	gBuiltins[keyOf("keysort", 2)] = &builtinPred{det: biKeysort}
+	gBuiltins[keyOf("predsort", 3)] = &builtinPred{detCtx: biPredsort}
+}
+
+// keyOf returns the Key() of the predicate name/arity.
+func keyOf(name string, arity int) predKey {
+	return predKey{functor: A(name), arity: arity}
+}
+
+// clauseRule converts a clause term, with current bindings in bds, to a new
+// rule. An error, e.g. type_error(callable, 3), is raised for the predicate
+// ctx if it is not a clause.
+func clauseRule(t Term, bds *Bindings, ctx Term) *Rule {
+	rule, err := toRule(t.unify(bds))
+	if err != nil {
+		throwClauseError(err, bds, ctx)
+	}
+	return rule
+}
+
+// throwClauseError raises err returned by toRule, toHead or toGoal, which is a
+// *PrologError, for the predicate ctx.
+func throwClauseError(err error, bds *Bindings, ctx Term) {
+	throwError(isoError(err.(*PrologError).Formal(), ctx), bds)
+}
+
+/* Database */
+
+// assertz(Clause), assert(Clause)
+func biAssertz(m *Machine, args []Term, bds *Bindings) bool {
+	m.addRule(clauseRule(args[0], bds, indicator(A("assertz"), 1)), false)
+	return true
+}
+
+// asserta(Clause)
+func biAsserta(m *Machine, args []Term, bds *Bindings) bool {
+	m.addRule(clauseRule(args[0], bds, indicator(A("asserta"), 1)), true)
+	return true
+}
+
+// clauseParts returns the head and the body of a clause term. The body is
+// true for a fact. An error is raised for the predicate ctx if the head is not
+// callable.
+func clauseParts(t Term, bds *Bindings, ctx Term) (head *ComplexTerm, body Term) {
+	t = bds.unifyVar(t)
+	if ct, isCt := t.(*ComplexTerm); isCt && len(ct.Args) == 2 &&
+		ct.Functor.String() == ":-" {
+		t, body = bds.unifyVar(ct.Args[0]), ct.Args[1]
+	} else {
+		body = A("true")
+	}
+
+	head, err := toHead(t)
+	if err != nil {
+		throwClauseError(err, bds, ctx)
+	}
+	return head, body
+}
+
+// retract(Clause) removes the clauses matching Clause on backtracking. The
+// clauses are the ones when it is called.
+func biRetract(m *Machine, args []Term, bds *Bindings) []func() bool {
+	head, body := clauseParts(args[0], bds, indicator(A("retract"), 1))
+
+	rules, _ := m.clauses(head, bds)
+	alts := make([]func() bool, len(rules))
+	for i, rule := range rules {
+		alts[i] = func() bool {
+			rBody, ok := rule.matchHead(head, bds)
+			if !ok {
+				return false
+			}
+			if rBody == nil {
+				rBody = And()
+			}
+			// fails if the clause has been removed
+			return matchTerm(goalTerm(rBody), body, bds) && m.RemoveRule(rule)
+		}
+	}
+	return alts
+}
+
+// retractall(Head) removes all the clauses whose heads match Head.
+func biRetractall(m *Machine, args []Term, bds *Bindings) bool {
+	head, err := toHead(bds.unifyVar(args[0]))
+	if err != nil {
+		throwClauseError(err, bds, indicator(A("retractall"), 1))
+	}
+
+	mk := bds.mark()
+	rules, defined := m.clauses(head, bds)
+	if !defined {
+		// an unknown procedure becomes a dynamic one without clauses
+		m.dynamic(head.Key())
+		return true
+	}
+	for _, rule := range rules {
+		if _, ok := rule.matchHead(head, bds); ok {
+			m.RemoveRule(rule)
+		}
+		bds.undo(mk)
+	}
+	return true
+}
+
+// predIndicator returns the Key() of the predicate indicator Name/Arity. An
+// error is raised for the predicate ctx if t is not one, e.g.
+// type_error(integer, a) for foo/a.
+func predIndicator(t Term, bds *Bindings, ctx Term) predKey {
+	var name, arity Term
+	switch pi := bds.unifyVar(t).(type) {
+	case variable:
+		throwError(instantiationError(ctx), bds)
+	case *buildin2:
+		if pi.Op == opDiv {
+			name, arity = bds.unifyVar(pi.L), bds.unifyVar(pi.R)
+		}
+	case *ComplexTerm:
+		if len(pi.Args) == 2 && pi.Functor.String() == "/" {
+			name, arity = bds.unifyVar(pi.Args[0]), bds.unifyVar(pi.Args[1])
+		}
+	}
+	if name == nil {
+		throwError(typeError("predicate_indicator", t, ctx), bds)
+	}
+	if name.Type() == ttVar || arity.Type() == ttVar {
+		throwError(instantiationError(ctx), bds)
+	}
+
+	n, ok := name.(atom)
+	if !ok {
+		throwError(typeError("atom", name, ctx), bds)
+	}
+	a, ok := arity.(Integer)
+	if !ok {
+		throwError(typeError("integer", arity, ctx), bds)
+	}
+	if a < 0 {
+		throwError(domainError("not_less_than_zero", arity, ctx), bds)
+	}
+	return predKey{functor: n, arity: int(a)}
+}
+
+// abolish(Name/Arity) removes the predicate Name/Arity.
+func biAbolish(m *Machine, args []Term, bds *Bindings) bool {
+	m.abolish(predIndicator(args[0], bds, indicator(A("abolish"), 1)))
+	return true
+}
+
+// dynamic(PIs) declares the predicates, which are a predicate indicator, or a
+// conjunction or a list of them.
+func biDynamic(m *Machine, args []Term, bds *Bindings) bool {
+	declareDynamic(m, args[0], bds)
+	return true
+}
+
+func declareDynamic(m *Machine, pis Term, bds *Bindings) {
+	switch t := bds.unifyVar(pis).(type) {
+	case variable:
+		throwError(instantiationError(indicator(A("dynamic"), 1)), bds)
+
+	case List:
+		for _, pi := range t {
+			declareDynamic(m, pi, bds)
+		}
+		return
+
+	case *ComplexTerm:
+		if len(t.Args) == 2 && t.Functor.String() == "," {
+			declareDynamic(m, t.Args[0], bds)
+			declareDynamic(m, t.Args[1], bds)
+			return
+		}
+	}
+
+	m.dynamic(predIndicator(pis, bds, indicator(A("dynamic"), 1)))
+}
+
+/* Flags */
+
+// set_prolog_flag(Flag, Value). Only the flag unknown is supported.
+func biSetPrologFlag(m *Machine, args []Term, bds *Bindings) bool {
+	ctx := indicator(A("set_prolog_flag"), 2)
+	flag, value := bds.unifyVar(args[0]), bds.unifyVar(args[1])
+	if flag.Type() == ttVar || value.Type() == ttVar {
+		throwError(instantiationError(ctx), bds)
+	}
+	if flag != A("unknown") {
+		throwError(domainError("prolog_flag", flag, ctx), bds)
+	}
+
+	for v, name := range unknownNames {
+		if value == A(name) {
+			m.unknown.Store(int32(v))
+			return true
+		}
+	}
+	throwError(domainError("flag_value", compound("+", flag, value), ctx), bds)
+	return false
+}
+
+// current_prolog_flag(Flag, Value). Only the flag unknown is supported.
+func biCurrentPrologFlag(m *Machine, args []Term, bds *Bindings) bool {
+	return matchTerm(args[0], A("unknown"), bds) &&
+		matchTerm(args[1], A(unknownNames[m.unknown.Load()]), bds)
+}
+
+/* Comparison of terms */
+
+// compare(Order, X, Y) unifies Order with <, = or >, as X is before, identical
+// to, or after Y in the standard order.
+func biCompare(m *Machine, args []Term, bds *Bindings) bool {
+	ctx := indicator(A("compare"), 3)
+	switch order := bds.unifyVar(args[0]).(type) {
+	case variable:
+	case atom:
+		if s := order.String(); s != "<" && s != "=" && s != ">" {
+			throwError(domainError("order", order, ctx), bds)
+		}
+	default:
+		throwError(typeError("atom", order, ctx), bds)
+	}
+
+	res := "="
+	switch c := compareTerms(args[1], args[2], bds); {
+	case c < 0:
+		res = "<"
+	case c > 0:
+		res = ">"
+	}
+	return matchTerm(args[0], A(res), bds)
+}
+
+/* Sorting */
+
+// listElems returns the elements of the list t, which has to be a proper list.
+// ctx is the predicate indicator for errors.
+func listElems(t Term, bds *Bindings, ctx Term) []Term {
+	var els []Term
+	for l := t; ; {
+		switch lt := bds.unifyVar(l).(type) {
+		case List:
+			return append(els, lt...)
+		case HeadTail:
+			els = append(els, lt.Head)
+			l = lt.Tail
+		case variable:
+			throwError(instantiationError(ctx), bds)
+		default:
+			throwError(typeError("list", t, ctx), bds)
+		}
+	}
+}
+
+// mergeSort returns ts sorted stably by cmp, which returns false for failure.
+// An element equal to an earlier one is dropped if dedup. ok is false if cmp
+// fails.
+func mergeSort(ts []Term, cmp func(a, b Term) (c int, ok bool), dedup bool) (sorted []Term, ok bool) {
+	if len(ts) < 2 {
+		return ts, true
+	}
+	l, ok := mergeSort(ts[:len(ts)/2], cmp, dedup)
+	if !ok {
+		return nil, false
+	}
+	r, ok := mergeSort(ts[len(ts)/2:], cmp, dedup)
+	if !ok {
+		return nil, false
+	}
+
+	sorted = make([]Term, 0, len(l)+len(r))
+	for len(l) > 0 && len(r) > 0 {
+		c, ok := cmp(l[0], r[0])
+		if !ok {
+			return nil, false
+		}
+		switch {
+		case c > 0:
+			sorted = append(sorted, r[0])
+			r = r[1:]
+		case c == 0 && dedup:
+			r = r[1:]
+		default:
+			sorted = append(sorted, l[0])
+			l = l[1:]
+		}
+	}
+	sorted = append(sorted, l...)
+	return append(sorted, r...), true
+}
+
+// sortTerms sorts els in the standard order of their keys.
+func sortTerms(els []Term, bds *Bindings, key func(t Term) Term, desc, dedup bool) List {
+	sorted, _ := mergeSort(els, func(a, b Term) (int, bool) {
+		c := compareTerms(key(a), key(b), bds)
+		if desc {
+			c = -c
+		}
+		return c, true
+	}, dedup)
+	return List(sorted)
+}
+
+func wholeTerm(t Term) Term {
+	return t
+}
+
+// msort(List, Sorted) sorts List in the standard order, keeping duplicates.
+func biMsort(m *Machine, args []Term, bds *Bindings) bool {
+	els := listElems(args[0], bds, indicator(A("msort"), 2))
+	return matchTerm(args[1], sortTerms(els, bds, wholeTerm, false, false), bds)
+}
+
+// sort(List, Sorted) sorts List in the standard order, removing duplicates.
+func biSort(m *Machine, args []Term, bds *Bindings) bool {
+	els := listElems(args[0], bds, indicator(A("sort"), 2))
+	return matchTerm(args[1], sortTerms(els, bds, wholeTerm, false, true), bds)
+}
+
+// sort(Key, Order, List, Sorted) sorts List by the Key-th arguments of its
+// elements, or the elements themselves if Key is 0. Order is @< or @> for
+// ascending or descending order removing duplicates, or @=< or @>= keeping
+// them in their original order.
+func biSort4(m *Machine, args []Term, bds *Bindings) bool {
+	ctx := indicator(A("sort"), 4)
+	key, order := bds.unifyVar(args[0]), bds.unifyVar(args[1])
+	if key.Type() == ttVar || order.Type() == ttVar {
+		throwError(instantiationError(ctx), bds)
+	}
+
+	n, ok := key.(Integer)
+	if !ok {
+		throwError(typeError("integer", key, ctx), bds)
+	}
+	if n < 0 {
+		throwError(domainError("not_less_than_zero", key, ctx), bds)
+	}
+
+	var desc, dedup bool
+	switch order {
+	case A("@<"):
+		dedup = true
+	case A("@=<"):
+	case A("@>"):
+		desc, dedup = true, true
+	case A("@>="):
+		desc = true
+	default:
+		if order.Type() != ttAtom {
+			throwError(typeError("atom", order, ctx), bds)
+		}
+		throwError(domainError("order", order, ctx), bds)
+	}
+
+	els := listElems(args[2], bds, ctx)
+	if n == 0 {
+		return matchTerm(args[3], sortTerms(els, bds, wholeTerm, desc, dedup), bds)
+	}
+
+	// the Key-th argument
+	arg := func(t Term) Term {
+		t = bds.unifyVar(t)
+		if orderRank(t) != orCompound {
+			throwError(typeError("compound", t, ctx), bds)
+		}
+		_, args := compoundParts(t)
+		if int(n) > len(args) {
+			throwError(typeError("compound", t, ctx), bds)
+		}
+		return args[n-1]
+	}
+	// raise errors of the elements even if not compared
+	for _, el := range els {
+		arg(el)
+	}
+	return matchTerm(args[3], sortTerms(els, bds, arg, desc, dedup), bds)
+}
+
+// keysort(Pairs, Sorted) sorts the Key-Value pairs by their keys, keeping
+// duplicates in their original order.
+func biKeysort(m *Machine, args []Term, bds *Bindings) bool {
+	ctx := indicator(A("keysort"), 2)
+	pairKey := func(t Term) Term {
+		switch p := bds.unifyVar(t).(type) {
+		case variable:
+			throwError(instantiationError(ctx), bds)
+		case *buildin2:
+			if p.Op == opMinus {
+				return p.L
+			}
+		case *ComplexTerm:
+			if len(p.Args) == 2 && p.Functor == A("-") {
+				return p.Args[0]
+			}
+		}
+		throwError(typeError("pair", t, ctx), bds)
+		return nil
+	}
+	els := listElems(args[0], bds, ctx)
+	for _, el := range els {
+		pairKey(el)
+	}
+	return matchTerm(args[1], sortTerms(els, bds, pairKey, false, false), bds)
+}
+
+// predsort(Pred, List, Sorted) sorts List by calling Pred(Order, A, B), where
+// Order is <, > or =. An element which is = to an earlier one is removed.
+// Fails if Pred fails. The bindings put by Pred are kept.
+func biPredsort(ctx context.Context, m *Machine, args []Term, bds *Bindings) bool {
+	pi := indicator(A("predsort"), 3)
+	sorted, ok := mergeSort(listElems(args[1], bds, pi), func(a, b Term) (int, bool) {
+		return callOrder(ctx, m, args[0], a, b, bds, pi)
+	}, true)
+	return ok && matchTerm(args[2], List(sorted), bds)
+}
+
+// callOrder proves the first solution of pred(Order, a, b) with bds, and
+// returns the order of a and b. ok is false if it fails. pi is the predicate
+// indicator for errors.
+func callOrder(ctx context.Context, m *Machine, pred, a, b Term, bds *Bindings, pi Term) (c int, ok bool) {
+	order := pV(bds.newVars(1))
+	args := []Term{order, a, b}
+	var call *ComplexTerm
+	switch p := bds.unifyVar(pred).(type) {
+	case variable:
+		throwError(instantiationError(pi), bds)
+	case atom:
+		call = &ComplexTerm{Functor: p, Args: args}
+	case *ComplexTerm:
+		pArgs := append(p.Args[:len(p.Args):len(p.Args)], args...)
+		call = &ComplexTerm{Functor: p.Functor, Args: pArgs}
+	default:
+		throwError(typeError("callable", pred, pi), bds)
+	}
+
+	if !m.once(ctx, call, bds) {
+		return 0, false
+	}
+
+	switch o := bds.unifyVar(order); o {
+	case A("<"):
+		return -1, true
+	case A("="):
+		return 0, true
+	case A(">"):
+		return 1, true
+	default:
+		throwError(domainError("order", o, pi), bds)
+	}
+	return 0, false
+}
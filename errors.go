@@ -0,0 +1,109 @@
+package plg
+
+import (
+	"fmt"
+)
+
+/*
+	Errors: *PrologError
+
+	An error raised while proving a goal is a term error(Formal, Context) as in
+	ISO Prolog, e.g. error(type_error(evaluable, foo/0), is/2). The Context is
+	the predicate indicator raising the error, or a variable if unknown.
+
+	Errors are raised as panics of *PrologError inside the engines, as balls
+	thrown by throw/1. A ball is caught by the innermost catch/3 whose catcher
+	matches it. An uncaught one is recovered by the query, which stops and
+	returns it by Err.
+*/
+
+// PrologError is an error term raised when proving a goal.
+type PrologError struct {
+	// the error term, i.e. error(Formal, Context)
+	Term Term
+}
+
+func (e *PrologError) Error() string {
+	return fmt.Sprint(e.Term)
+}
+
+// Formal returns the formal part of the error term, e.g.
+// type_error(evaluable, foo/0). Returns the term itself if it is not of the
+// form error(Formal, Context).
+func (e *PrologError) Formal() Term {
+	if ct, ok := e.Term.(*ComplexTerm); ok && len(ct.Args) == 2 &&
+		ct.Functor.String() == "error" {
+		return ct.Args[0]
+	}
+	return e.Term
+}
+
+// isoError returns the error error(formal, ctx). A nil ctx is unknown.
+func isoError(formal, ctx Term) *PrologError {
+	if ctx == nil {
+		ctx = genUniqueVar()
+	}
+	return &PrologError{Term: CT(A("error"), formal, ctx)}
+}
+
+// indicator returns the predicate indicator name/arity.
+func indicator(name atom, arity int) Term {
+	return &buildin2{Op: opDiv, L: name, R: Integer(arity)}
+}
+
+// instantiationError is raised when an argument is unbound.
+func instantiationError(ctx Term) *PrologError {
+	return isoError(A("instantiation_error"), ctx)
+}
+
+// typeError is raised when culprit is not of the type, e.g. callable or
+// evaluable.
+func typeError(typ string, culprit Term, ctx Term) *PrologError {
+	return isoError(CT(A("type_error"), A(typ), culprit), ctx)
+}
+
+// domainError is raised when culprit is of the right type but not in the
+// domain, e.g. prolog_flag.
+func domainError(domain string, culprit Term, ctx Term) *PrologError {
+	return isoError(CT(A("domain_error"), A(domain), culprit), ctx)
+}
+
+// evaluationError is raised when evaluating an expression fails, e.g. with
+// zero_divisor.
+func evaluationError(e string, ctx Term) *PrologError {
+	return isoError(CT(A("evaluation_error"), A(e)), ctx)
+}
+
+// existenceError is raised when calling the predicate name/arity which does
+// not exist.
+func existenceError(name atom, arity int, ctx Term) *PrologError {
+	return isoError(CT(A("existence_error"), A("procedure"), indicator(name, arity)), ctx)
+}
+
+// throwError raises err, with the variables in its term bound in bds
+// exported, so that the term is still valid after bds is undone.
+func throwError(err *PrologError, bds *Bindings) {
+	panic(&PrologError{Term: err.Term.export(bds)})
+}
+
+// throwBall raises ball by throw/1.
+func throwBall(ball Term, bds *Bindings) {
+	if bds.unifyVar(ball).Type() == ttVar {
+		throwError(instantiationError(indicator(A("throw"), 1)), bds)
+	}
+	throwError(&PrologError{Term: ball}, bds)
+}
+
+// recoverError recovers a panic of *PrologError into *err. Other panics are
+// not recovered. It has to be deferred directly, i.e. defer recoverError(&err).
+func recoverError(err **PrologError) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	pe, ok := r.(*PrologError)
+	if !ok {
+		panic(r)
+	}
+	*err = pe
+}
@@ -0,0 +1,253 @@
+package plg
+
+import (
+	"math"
+)
+
+/*
+	Clause indexing: *predicate
+
+	The clauses of a predicate are indexed by the first argument of their
+	heads, so a call with a bound first argument only tries the clauses whose
+	first argument may match it. Clauses whose first argument is a variable,
+	or any other term that cannot be indexed, are candidates of all calls.
+
+	Indexes on other arguments are built just in time, when a call of a
+	predicate with enough clauses has a bound value at the argument. All the
+	indexes are updated when a clause is added or removed.
+
+	A call keeps the list of clauses it got, which is never modified in place,
+	so adding or removing clauses does not disturb running calls, i.e. the
+	logical update view. It also makes the list safe to read without the lock
+	of the Machine.
+*/
+
+// argKey is the index key of a bound argument.
+type argKey struct {
+	// ttAtom, ttInt, ttFloat, ttBigInt, ttRational, ttComplex, ttList or
+	// ttBuildin
+	tt int
+	// the atom, or the functor of the term
+	at atom
+	// the integer, bits of the float, lowest bits of the big integer or the
+	// numerator of the rational, arity of the term, len of the list (0 or 1), or
+	// the operator
+	val int
+}
+
+// argKeyOf returns the index key of t. ok is false if t cannot be indexed,
+// e.g. a variable.
+func argKeyOf(t Term) (k argKey, ok bool) {
+	switch t := t.(type) {
+	case atom:
+		return argKey{tt: ttAtom, at: t}, true
+	case Integer:
+		return argKey{tt: ttInt, val: int(t)}, true
+	case Float:
+		if t == 0 {
+			// -0.0 matches 0.0
+			return argKey{tt: ttFloat}, true
+		}
+		return argKey{tt: ttFloat, val: int(math.Float64bits(float64(t)))}, true
+	case BigInt:
+		return argKey{tt: ttBigInt, val: int(t.i.Int64())}, true
+	case Rational:
+		return argKey{tt: ttRational, val: int(t.r.Num().Int64())}, true
+	case *ComplexTerm:
+		return argKey{tt: ttComplex, at: t.Functor, val: len(t.Args)}, true
+	case List:
+		if len(t) == 0 {
+			return argKey{tt: ttList}, true
+		}
+		return argKey{tt: ttList, val: 1}, true
+	case HeadTail:
+		return argKey{tt: ttList, val: 1}, true
+	case *buildin2:
+		return argKey{tt: ttBuildin, val: t.Op}, true
+	}
+
+	// variables and FirstLeft's
+	return argKey{}, false
+}
+
+/* argIndex: clauses indexed by an argument */
+
+type argIndex struct {
+	pos int
+	// key -> clauses, in order, including the ones in vars
+	keys map[argKey][]*Rule
+	// clauses with unindexable arguments at pos
+	vars []*Rule
+}
+
+func newArgIndex(pos int, rules []*Rule) *argIndex {
+	idx := &argIndex{pos: pos, keys: make(map[argKey][]*Rule)}
+	for _, rule := range rules {
+		idx.add(rule, false)
+	}
+	return idx
+}
+
+// add adds rule as the last clause, or the first one if front is true.
+func (idx *argIndex) add(rule *Rule, front bool) {
+	k, ok := argKeyOf(rule.Head.Args[idx.pos])
+	if !ok {
+		// a candidate of all keys
+		idx.vars = insertRule(idx.vars, rule, front)
+		for k, rules := range idx.keys {
+			idx.keys[k] = insertRule(rules, rule, front)
+		}
+		return
+	}
+
+	rules, found := idx.keys[k]
+	if !found {
+		// the clauses of a new key start with the unindexable ones
+		rules = append([]*Rule(nil), idx.vars...)
+	}
+	idx.keys[k] = insertRule(rules, rule, front)
+}
+
+func (idx *argIndex) remove(rule *Rule) {
+	k, ok := argKeyOf(rule.Head.Args[idx.pos])
+	if ok {
+		idx.keys[k] = removeRule(idx.keys[k], rule)
+		return
+	}
+
+	idx.vars = removeRule(idx.vars, rule)
+	for k, rules := range idx.keys {
+		idx.keys[k] = removeRule(rules, rule)
+	}
+}
+
+// lookup returns the clauses possibly matching an argument with key k.
+func (idx *argIndex) lookup(k argKey) []*Rule {
+	if rules, ok := idx.keys[k]; ok {
+		return rules
+	}
+	return idx.vars
+}
+
+/* predicate: the clauses of a predicate */
+
+// jitMinClauses is the least number of clauses of a predicate to build an
+// index on an argument other than the first one.
+const jitMinClauses = 8
+
+type predicate struct {
+	rules []*Rule
+	// pos -> the index on the argument, nil if not built. The first one is
+	// always built.
+	indexes []*argIndex
+}
+
+// add adds rule as the last clause, or the first one if front is true.
+func (p *predicate) add(rule *Rule, front bool) {
+	p.rules = insertRule(p.rules, rule, front)
+	if len(rule.Head.Args) == 0 {
+		return
+	}
+
+	if p.indexes == nil {
+		p.indexes = make([]*argIndex, len(rule.Head.Args))
+		p.indexes[0] = newArgIndex(0, nil)
+	}
+	for _, idx := range p.indexes {
+		if idx != nil {
+			idx.add(rule, front)
+		}
+	}
+}
+
+// remove removes rule. Returns false if rule is not a clause of p.
+func (p *predicate) remove(rule *Rule) bool {
+	if p == nil {
+		return false
+	}
+
+	n := len(p.rules)
+	if p.rules = removeRule(p.rules, rule); len(p.rules) == n {
+		return false
+	}
+	for _, idx := range p.indexes {
+		if idx != nil {
+			idx.remove(rule)
+		}
+	}
+	return true
+}
+
+// clauses returns the clauses possibly matching q, in order. The index with
+// fewest candidates on the bound arguments of q is used. If an index should be
+// built but build is false, ok is false.
+func (p *predicate) clauses(q *ComplexTerm, bds *Bindings, build bool) (rules []*Rule, ok bool) {
+	if p == nil {
+		return nil, true
+	}
+
+	rules = p.rules
+	for pos, idx := range p.indexes {
+		if len(rules) <= 1 {
+			break
+		}
+
+		k, ok := argKeyOf(bds.unifyVar(q.Args[pos]))
+		if !ok {
+			continue
+		}
+
+		if idx == nil {
+			if len(p.rules) < jitMinClauses {
+				continue
+			}
+			if !build {
+				return nil, false
+			}
+			idx = newArgIndex(pos, p.rules)
+			p.indexes[pos] = idx
+		}
+
+		if cands := idx.lookup(k); len(cands) < len(rules) {
+			rules = cands
+		}
+	}
+	return rules, true
+}
+
+// indexed returns the argument positions with an index, starting from 1.
+func (p *predicate) indexed() (args []int) {
+	if p == nil {
+		return nil
+	}
+
+	for pos, idx := range p.indexes {
+		if idx != nil {
+			args = append(args, pos+1)
+		}
+	}
+	return args
+}
+
+// insertRule returns rules with rule appended, or inserted at the front if
+// front is true. The elements of rules are not modified.
+func insertRule(rules []*Rule, rule *Rule, front bool) []*Rule {
+	if front {
+		return append([]*Rule{rule}, rules...)
+	}
+	// the elements before len(rules) are kept
+	return append(rules, rule)
+}
+
+// removeRule returns a new slice of rules without rule, or rules itself if
+// rule is not in it.
+func removeRule(rules []*Rule, rule *Rule) []*Rule {
+	for i, r := range rules {
+		if r == rule {
+			res := make([]*Rule, 0, len(rules)-1)
+			res = append(res, rules[:i]...)
+			return append(res, rules[i+1:]...)
+		}
+	}
+	return rules
+}
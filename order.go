@@ -0,0 +1,173 @@
+package plg
+
+import (
+	"cmp"
+	"fmt"
+	"strings"
+)
+
+/*
+	Standard order of terms: Compare
+
+	Var < Number < Atom < Compound
+
+	Variables are ordered by their identities, which is fixed but unspecified.
+	Numbers are ordered by their values, and a float is before an integer or
+	rational of the same value. Atoms are ordered alphabetically. Compound terms
+	are ordered by their arities, then their names, then their arguments from
+	left to right.
+
+	A non-empty list is the compound term '.'(Head, Tail), and [] is an atom. A
+	*buildin2 is the compound term of its operator, and a FirstLeft is an atom
+	ordered by its first char then the rest of it.
+
+	Terms of the same name and arguments but in representations which do not
+	unify, e.g. '[]' and [], or '+'(1, 2) made by CT and 1 + 2 made by Op, are
+	ordered by their representations at last, so that A == B implies A = B.
+*/
+
+// Ranks of terms in the standard order.
+const (
+	orVar = iota
+	orNumber
+	orAtom
+	orCompound
+)
+
+// Compare compares the terms a and b in the standard order. Returns -1 if a is
+// before b, 0 if they are identical, and 1 if a is after b.
+func Compare(a, b Term) int {
+	return compareTerms(a, b, nil)
+}
+
+// compareTerms compares a and b with current bindings in bds, which can be nil.
+func compareTerms(a, b Term, bds *Bindings) int {
+	a, b = bds.unifyVar(a), bds.unifyVar(b)
+	if c := cmp.Compare(orderRank(a), orderRank(b)); c != 0 {
+		return c
+	}
+
+	switch orderRank(a) {
+	case orVar:
+		av, bv := a.(variable), b.(variable)
+		if c := cmp.Compare(av.id, bv.id); c != 0 {
+			return c
+		}
+		return strings.Compare(av.String(), bv.String())
+
+	case orNumber:
+		if c := compareNum(a, b); c != 0 {
+			return c
+		}
+		// a float is before an integer of the same value
+		return cmp.Compare(orderKind(a), orderKind(b))
+
+	case orAtom:
+		fa, aIsFL := a.(FirstLeft)
+		fb, bIsFL := b.(FirstLeft)
+		if !aIsFL && !bIsFL {
+			if c := strings.Compare(atomText(a), atomText(b)); c != 0 {
+				return c
+			}
+			return cmp.Compare(reprKind(a), reprKind(b))
+		}
+		if !aIsFL {
+			if fa, aIsFL = splitAtom(atomText(a)); !aIsFL {
+				// '' is before any FirstLeft
+				return -1
+			}
+		}
+		if !bIsFL {
+			if fb, bIsFL = splitAtom(atomText(b)); !bIsFL {
+				return 1
+			}
+		}
+		if c := compareTerms(fa.First, fb.First, bds); c != 0 {
+			return c
+		}
+		return compareTerms(fa.Left, fb.Left, bds)
+	}
+
+	an, aArgs := compoundParts(a)
+	bn, bArgs := compoundParts(b)
+	if c := cmp.Compare(len(aArgs), len(bArgs)); c != 0 {
+		return c
+	}
+	if c := strings.Compare(an.String(), bn.String()); c != 0 {
+		return c
+	}
+	for i := range aArgs {
+		if c := compareTerms(aArgs[i], bArgs[i], bds); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(reprKind(a), reprKind(b))
+}
+
+func orderRank(t Term) int {
+	switch t := t.(type) {
+	case variable:
+		return orVar
+	case Integer, BigInt, Rational, Float:
+		return orNumber
+	case atom, FirstLeft:
+		return orAtom
+	case List:
+		if len(t) == 0 {
+			return orAtom
+		}
+	}
+	return orCompound
+}
+
+// orderKind returns 0 for a float, and 1 for other numbers.
+func orderKind(t Term) int {
+	if _, ok := t.(Float); ok {
+		return 0
+	}
+	return 1
+}
+
+// reprKind returns the kind of the representation of an atom or a compound
+// term. Kinds differ for representations which do not unify with each other.
+func reprKind(t Term) int {
+	switch t.(type) {
+	case *buildin2:
+		return 1
+	case List, HeadTail:
+		return 2
+	}
+	return 0
+}
+
+// atomText returns the text of an atom, or [] for the empty list.
+func atomText(t Term) string {
+	if at, ok := t.(atom); ok {
+		return at.String()
+	}
+	return "[]"
+}
+
+// splitAtom splits the text of an atom into a FirstLeft. ok is false if the
+// text is empty.
+func splitAtom(s string) (fl FirstLeft, ok bool) {
+	if len(s) == 0 {
+		return fl, false
+	}
+	return FirstLeft{First: A(s[:1]), Left: A(s[1:])}, true
+}
+
+// compoundParts returns the name and the arguments of the compound term t.
+func compoundParts(t Term) (name atom, args []Term) {
+	switch t := t.(type) {
+	case *ComplexTerm:
+		return t.Functor, t.Args
+	case *buildin2:
+		return opFunctors[t.Op], []Term{t.L, t.R}
+	case List:
+		return A("."), []Term{t[0], t[1:]}
+	case HeadTail:
+		return A("."), []Term{t.Head, t.Tail}
+	}
+	panic(fmt.Sprintf("%v is not a compound term!", t))
+}
@@ -0,0 +1,1185 @@
+package plg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+/*
+	Parser of Prolog source text in standard (Edinburgh/ISO) syntax.
+
+	ParseTerm     a single term
+	ParseGoal     a single goal
+	ParseClauses  all clauses of a program
+*/
+
+// SyntaxError is returned by the parser when the source text is not valid.
+type SyntaxError struct {
+	Line, Column int
+	Msg          string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at %d:%d: %s", e.Line, e.Column, e.Msg)
+}
+
+/* Tokens */
+
+// Constants for token kinds.
+const (
+	tkEOF   = iota
+	tkName  // atom names, including quoted atoms and symbol chars
+	tkVar   // variables
+	tkInt   // integer numbers
+	tkFloat // floating point numbers
+	tkRat   // rational numbers, e.g. 1r3
+	tkStr   // "double quoted"
+	tkPunct // ( ) [ ] { } , |
+	tkEnd   // the end dot
+)
+
+type token struct {
+	kind   int
+	text   string
+	quoted bool // quoted name, never an operator
+	layout bool // preceded by layout text
+
+	line, col int
+}
+
+func (tk token) String() string {
+	switch tk.kind {
+	case tkEOF:
+		return "end of file"
+	case tkEnd:
+		return "end of clause"
+	}
+	return strconv.Quote(tk.text)
+}
+
+func (tk token) isPunct(p string) bool {
+	return tk.kind == tkPunct && tk.text == p
+}
+
+/* lexer */
+
+type lexer struct {
+	in *bufio.Reader
+
+	line, col int
+	// runes and their positions pushed back by unread
+	back []rune
+	pos  [][2]int
+
+	peeked *token
+}
+
+func newLexer(r io.Reader) *lexer {
+	return &lexer{in: bufio.NewReader(r), line: 1, col: 1}
+}
+
+func (lx *lexer) errorf(line, col int, format string, args ...interface{}) error {
+	return &SyntaxError{Line: line, Column: col, Msg: fmt.Sprintf(format, args...)}
+}
+
+// returns -1 at EOF
+func (lx *lexer) read() (r rune) {
+	if n := len(lx.back); n > 0 {
+		r, lx.back = lx.back[n-1], lx.back[:n-1]
+	} else {
+		var err error
+		if r, _, err = lx.in.ReadRune(); err != nil {
+			return -1
+		}
+	}
+
+	lx.pos = append(lx.pos, [2]int{lx.line, lx.col})
+	if r == '\n' {
+		lx.line++
+		lx.col = 1
+	} else {
+		lx.col++
+	}
+	return r
+}
+
+// unread pushes back r, which must be the last read rune.
+func (lx *lexer) unread(r rune) {
+	if r < 0 {
+		return
+	}
+	lx.back = append(lx.back, r)
+	n := len(lx.pos) - 1
+	lx.line, lx.col = lx.pos[n][0], lx.pos[n][1]
+	lx.pos = lx.pos[:n]
+}
+
+func (lx *lexer) peekRune() rune {
+	r := lx.read()
+	lx.unread(r)
+	return r
+}
+
+func isSymbolChar(r rune) bool {
+	return r >= 0 && strings.ContainsRune("+-*/\\^<>=~:.?@#&$", r)
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+func isAlnum(r rune) bool {
+	return r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' ||
+		isDigit(r)
+}
+
+func isLayout(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\f' ||
+		r == '\v'
+}
+
+// skipLayout skips white spaces and comments. Returns true if anything was
+// skipped.
+func (lx *lexer) skipLayout() (skipped bool, err error) {
+	for {
+		r := lx.read()
+		switch {
+		case isLayout(r):
+			skipped = true
+
+		case r == '%':
+			for r >= 0 && r != '\n' {
+				r = lx.read()
+			}
+			skipped = true
+
+		case r == '/' && lx.peekRune() == '*':
+			line, col := lx.line, lx.col-1
+			lx.read()
+			for {
+				r = lx.read()
+				if r < 0 {
+					return skipped, lx.errorf(line, col,
+						"unterminated block comment")
+				}
+				if r == '*' && lx.peekRune() == '/' {
+					lx.read()
+					break
+				}
+			}
+			skipped = true
+
+		default:
+			lx.unread(r)
+			return skipped, nil
+		}
+	}
+}
+
+func (lx *lexer) peek() (token, error) {
+	if lx.peeked == nil {
+		tk, err := lx.scan()
+		if err != nil {
+			return tk, err
+		}
+		lx.peeked = &tk
+	}
+	return *lx.peeked, nil
+}
+
+func (lx *lexer) next() (token, error) {
+	tk, err := lx.peek()
+	lx.peeked = nil
+	return tk, err
+}
+
+func (lx *lexer) scan() (tk token, err error) {
+	lx.pos = lx.pos[:0]
+	if tk.layout, err = lx.skipLayout(); err != nil {
+		return tk, err
+	}
+
+	tk.line, tk.col = lx.line, lx.col
+	r := lx.read()
+	switch {
+	case r < 0:
+		tk.kind = tkEOF
+
+	case isDigit(r):
+		tk.kind, tk.text, err = lx.scanNumber(r, tk)
+
+	case r == '_' || r >= 'A' && r <= 'Z':
+		tk.kind, tk.text = tkVar, lx.scanAlnum(r)
+
+	case r >= 'a' && r <= 'z':
+		tk.kind, tk.text = tkName, lx.scanAlnum(r)
+
+	case r == '\'':
+		tk.kind, tk.quoted = tkName, true
+		tk.text, err = lx.scanQuoted(r, tk)
+
+	case r == '"':
+		tk.kind = tkStr
+		tk.text, err = lx.scanQuoted(r, tk)
+
+	case strings.ContainsRune("()[]{},|", r):
+		tk.kind, tk.text = tkPunct, string(r)
+		if r == '|' && lx.peekRune() == '|' {
+			lx.read()
+			tk.kind, tk.text = tkName, "||"
+		}
+
+	case r == '!' || r == ';':
+		tk.kind, tk.text = tkName, string(r)
+
+	case r == '.' && func() bool {
+		nr := lx.peekRune()
+		return nr < 0 || isLayout(nr) || nr == '%'
+	}():
+		tk.kind, tk.text = tkEnd, "."
+
+	case isSymbolChar(r):
+		var buf bytes.Buffer
+		for isSymbolChar(r) {
+			buf.WriteRune(r)
+			r = lx.read()
+		}
+		lx.unread(r)
+		tk.kind, tk.text = tkName, buf.String()
+
+	default:
+		err = lx.errorf(tk.line, tk.col, "unexpected character %q", r)
+	}
+
+	return tk, err
+}
+
+func (lx *lexer) scanAlnum(r rune) string {
+	var buf bytes.Buffer
+	for isAlnum(r) {
+		buf.WriteRune(r)
+		r = lx.read()
+	}
+	lx.unread(r)
+	return buf.String()
+}
+
+// scanNumber returns the decimal text of an integer, or the text of a float or
+// rational number. kind is tkInt, tkFloat or tkRat. r is the first digit.
+func (lx *lexer) scanNumber(r rune, tk token) (kind int, text string, err error) {
+	if r == '0' {
+		switch nr := lx.peekRune(); nr {
+		case '\'':
+			// character code: 0'c
+			lx.read()
+			c := lx.read()
+			switch {
+			case c < 0:
+				return tkInt, "", lx.errorf(tk.line, tk.col, "unexpected end of file")
+			case c == '\\':
+				esc, err := lx.scanEscape(tk)
+				if err != nil {
+					return tkInt, "", err
+				}
+				if esc < 0 {
+					return tkInt, "", lx.errorf(tk.line, tk.col, "invalid character code")
+				}
+				c = esc
+			case c == '\'' && lx.peekRune() == '\'':
+				lx.read()
+			}
+			return tkInt, strconv.Itoa(int(c)), nil
+
+		case 'x', 'o', 'b':
+			base := map[rune]int{'x': 16, 'o': 8, 'b': 2}[nr]
+			lx.read()
+			var buf bytes.Buffer
+			for {
+				c := lx.read()
+				if _, err := strconv.ParseInt(string(c), base, 8); c < 0 || err != nil {
+					lx.unread(c)
+					break
+				}
+				buf.WriteRune(c)
+			}
+			i, ok := new(big.Int).SetString(buf.String(), base)
+			if !ok {
+				return tkInt, "", lx.errorf(tk.line, tk.col, "invalid number: %q", buf.String())
+			}
+			return tkInt, i.String(), nil
+		}
+	}
+
+	var buf bytes.Buffer
+	r = lx.scanDigits(&buf, r)
+	if r == 'r' && isDigit(lx.peekRune()) {
+		// rational: NrD
+		buf.WriteRune(r)
+		lx.unread(lx.scanDigits(&buf, lx.read()))
+		return tkRat, buf.String(), nil
+	}
+	if r != '.' || !isDigit(lx.peekRune()) {
+		lx.unread(r)
+		return tkInt, buf.String(), nil
+	}
+
+	// fraction
+	buf.WriteRune(r)
+	r = lx.scanDigits(&buf, lx.read())
+
+	// exponent
+	if r == 'e' || r == 'E' {
+		sign := lx.read()
+		if isDigit(sign) {
+			buf.WriteRune(r)
+			r = lx.scanDigits(&buf, sign)
+		} else if (sign == '+' || sign == '-') && isDigit(lx.peekRune()) {
+			buf.WriteRune(r)
+			buf.WriteRune(sign)
+			r = lx.scanDigits(&buf, lx.read())
+		} else {
+			lx.unread(sign)
+		}
+	}
+	lx.unread(r)
+	return tkFloat, buf.String(), nil
+}
+
+// scanDigits writes the digits starting from r into buf, and returns the rune
+// after them.
+func (lx *lexer) scanDigits(buf *bytes.Buffer, r rune) rune {
+	for isDigit(r) {
+		buf.WriteRune(r)
+		r = lx.read()
+	}
+	return r
+}
+
+// scanEscape scans an escape sequence after the backslash. Returns -1 for a
+// line continuation.
+func (lx *lexer) scanEscape(tk token) (rune, error) {
+	c := lx.read()
+	switch c {
+	case 'n':
+		return '\n', nil
+	case 't':
+		return '\t', nil
+	case 'r':
+		return '\r', nil
+	case 'a':
+		return '\a', nil
+	case 'b':
+		return '\b', nil
+	case 'f':
+		return '\f', nil
+	case 'v':
+		return '\v', nil
+	case 'e':
+		return 27, nil
+	case 's':
+		return ' ', nil
+	case 'z':
+		return -1, nil
+	case '0', '1', '2', '3', '4', '5', '6', '7', 'x':
+		base, digits := 8, string(c)
+		if c == 'x' {
+			base, digits = 16, ""
+		}
+		for {
+			d := lx.read()
+			if d == '\\' {
+				break
+			}
+			if _, err := strconv.ParseInt(string(d), base, 8); d < 0 || err != nil {
+				return 0, lx.errorf(tk.line, tk.col, "invalid escape sequence")
+			}
+			digits += string(d)
+		}
+		code, err := strconv.ParseInt(digits, base, 32)
+		if err != nil {
+			return 0, lx.errorf(tk.line, tk.col, "invalid escape sequence")
+		}
+		return rune(code), nil
+	case '\n':
+		return -1, nil
+	case '\\', '\'', '"', '`':
+		return c, nil
+	}
+	return 0, lx.errorf(tk.line, tk.col, "invalid escape sequence")
+}
+
+// scanQuoted scans the text quoted by q. The opening quote has been read.
+func (lx *lexer) scanQuoted(q rune, tk token) (string, error) {
+	var buf bytes.Buffer
+	for {
+		r := lx.read()
+		switch r {
+		case -1:
+			return "", lx.errorf(tk.line, tk.col, "unterminated quoted")
+
+		case q:
+			if lx.peekRune() != q {
+				return buf.String(), nil
+			}
+			lx.read()
+
+		case '\\':
+			esc, err := lx.scanEscape(tk)
+			if err != nil {
+				return "", err
+			}
+			if esc < 0 {
+				continue
+			}
+			r = esc
+		}
+		buf.WriteRune(r)
+	}
+}
+
+/* Operators */
+
+// Constants for operator types.
+const (
+	xfx = iota
+	xfy
+	yfx
+	fy
+	fx
+)
+
+type opDef struct {
+	priority int
+	typ      int
+}
+
+type opTable struct {
+	prefix map[string]opDef
+	infix  map[string]opDef
+}
+
+func newOpTable() *opTable {
+	tbl := &opTable{prefix: make(map[string]opDef),
+		infix: make(map[string]opDef)}
+
+	for _, def := range []struct {
+		priority int
+		typ      int
+		names    string
+	}{
+		{1200, xfx, ":- -->"},
+		{1200, fx, ":- ?-"},
+		{1150, fx, "dynamic discontiguous initialization"},
+		{1100, xfy, "; |"},
+		{1050, xfy, "-> *->"},
+		{1000, xfy, ","},
+		{900, fy, "\\+"},
+		{700, xfx, "= \\= == \\== @< @> @=< @>= =.. is =:= =\\= < > =< >="},
+		{600, xfy, ":"},
+		{500, yfx, "+ - /\\ \\/ xor"},
+		{400, yfx, "* / // rem mod div << >> rdiv"},
+		{200, xfx, "**"},
+		{200, xfy, "^"},
+		{200, fy, "- + \\"},
+	} {
+		for _, name := range strings.Fields(def.names) {
+			if def.typ == fx || def.typ == fy {
+				tbl.prefix[name] = opDef{def.priority, def.typ}
+			} else {
+				tbl.infix[name] = opDef{def.priority, def.typ}
+			}
+		}
+	}
+	return tbl
+}
+
+var gOpTable = newOpTable()
+
+/* parser */
+
+type parser struct {
+	lx  *lexer
+	ops *opTable
+}
+
+func newParser(r io.Reader) *parser {
+	return &parser{lx: newLexer(r), ops: gOpTable}
+}
+
+func (p *parser) errorf(tk token, format string, args ...interface{}) error {
+	return p.lx.errorf(tk.line, tk.col, format, args...)
+}
+
+func (p *parser) expect(punct string) error {
+	tk, err := p.lx.next()
+	if err != nil {
+		return err
+	}
+	if !tk.isPunct(punct) {
+		return p.errorf(tk, "expected %q but found %v", punct, tk)
+	}
+	return nil
+}
+
+// readClause reads a term ended by an end dot. Returns nil, nil at EOF.
+func (p *parser) readClause() (Term, error) {
+	tk, err := p.lx.peek()
+	if err != nil {
+		return nil, err
+	}
+	if tk.kind == tkEOF {
+		return nil, nil
+	}
+
+	t, err := p.parse(1200)
+	if err != nil {
+		return nil, err
+	}
+
+	if tk, err = p.lx.next(); err != nil {
+		return nil, err
+	}
+	if tk.kind != tkEnd {
+		return nil, p.errorf(tk, "operator expected, found %v", tk)
+	}
+
+	return t, nil
+}
+
+// isTermStart returns true if tk can start a term.
+func (p *parser) isTermStart(tk token) bool {
+	switch tk.kind {
+	case tkEOF, tkEnd:
+		return false
+	case tkPunct:
+		return tk.text == "(" || tk.text == "[" || tk.text == "{"
+	case tkName:
+		if tk.quoted {
+			return true
+		}
+		if _, ok := p.ops.infix[tk.text]; ok {
+			_, ok = p.ops.prefix[tk.text]
+			return ok
+		}
+	}
+	return true
+}
+
+// parse parses a term with priority no higher than maxPrec.
+func (p *parser) parse(maxPrec int) (Term, error) {
+	left, leftPrec, err := p.parsePrimary(maxPrec)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tk, err := p.lx.peek()
+		if err != nil {
+			return nil, err
+		}
+
+		name := tk.text
+		switch {
+		case tk.kind == tkName && !tk.quoted:
+		case tk.isPunct(","):
+		case tk.isPunct("|"):
+			name = ";"
+		default:
+			return left, nil
+		}
+
+		def, ok := p.ops.infix[tk.text]
+		if !ok || def.priority > maxPrec {
+			return left, nil
+		}
+
+		leftMax, rightMax := def.priority-1, def.priority-1
+		switch def.typ {
+		case xfy:
+			rightMax = def.priority
+		case yfx:
+			leftMax = def.priority
+		}
+		if leftPrec > leftMax {
+			return left, nil
+		}
+
+		p.lx.next()
+		right, err := p.parse(rightMax)
+		if err != nil {
+			return nil, err
+		}
+		left, leftPrec = compound(name, left, right), def.priority
+	}
+}
+
+// parsePrimary parses a primary term or a prefix operator term.
+func (p *parser) parsePrimary(maxPrec int) (t Term, prec int, err error) {
+	tk, err := p.lx.next()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch tk.kind {
+	case tkInt:
+		t, err = p.parseInt(tk, false)
+		return t, 0, err
+
+	case tkFloat:
+		t, err = p.parseFloat(tk, false)
+		return t, 0, err
+
+	case tkRat:
+		t, err = p.parseRat(tk, false)
+		return t, 0, err
+
+	case tkVar:
+		return p.variable(tk.text), 0, nil
+
+	case tkStr:
+		codes := make(List, 0, len(tk.text))
+		for _, c := range tk.text {
+			codes = append(codes, Integer(c))
+		}
+		return codes, 0, nil
+
+	case tkPunct:
+		switch tk.text {
+		case "(":
+			if t, err = p.parse(1200); err != nil {
+				return nil, 0, err
+			}
+			return t, 0, p.expect(")")
+
+		case "[":
+			t, err = p.parseList()
+			return t, 0, err
+
+		case "{":
+			nx, err := p.lx.peek()
+			if err != nil {
+				return nil, 0, err
+			}
+			if nx.isPunct("}") {
+				p.lx.next()
+				return A("{}"), 0, nil
+			}
+			if t, err = p.parse(1200); err != nil {
+				return nil, 0, err
+			}
+			return CT(A("{}"), t), 0, p.expect("}")
+		}
+		return nil, 0, p.errorf(tk, "unexpected %v", tk)
+
+	case tkName:
+		return p.parseName(tk, maxPrec)
+	}
+
+	return nil, 0, p.errorf(tk, "unexpected %v", tk)
+}
+
+func (p *parser) parseName(tk token, maxPrec int) (t Term, prec int, err error) {
+	nx, err := p.lx.peek()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if nx.isPunct("(") && !nx.layout {
+		// functional notation
+		p.lx.next()
+		var args []Term
+		for {
+			arg, err := p.parse(999)
+			if err != nil {
+				return nil, 0, err
+			}
+			args = append(args, arg)
+
+			if nx, err = p.lx.next(); err != nil {
+				return nil, 0, err
+			}
+			if nx.isPunct(")") {
+				break
+			}
+			if !nx.isPunct(",") {
+				return nil, 0, p.errorf(nx, "expected \",\" or \")\" but found %v", nx)
+			}
+		}
+		return compound(tk.text, args...), 0, nil
+	}
+
+	if tk.quoted {
+		return A(tk.text), 0, nil
+	}
+
+	if tk.text == "-" && !nx.layout {
+		// negative numbers
+		switch nx.kind {
+		case tkInt:
+			p.lx.next()
+			t, err = p.parseInt(nx, true)
+			return t, 0, err
+		case tkFloat:
+			p.lx.next()
+			t, err = p.parseFloat(nx, true)
+			return t, 0, err
+		case tkRat:
+			p.lx.next()
+			t, err = p.parseRat(nx, true)
+			return t, 0, err
+		}
+	}
+
+	def, ok := p.ops.prefix[tk.text]
+	if !ok || !p.isTermStart(nx) {
+		return A(tk.text), 0, nil
+	}
+
+	if def.priority > maxPrec {
+		return nil, 0, p.errorf(tk, "operator priority clash: %s (%d) exceeds %d",
+			tk.text, def.priority, maxPrec)
+	}
+	argMax := def.priority
+	if def.typ == fx {
+		argMax--
+	}
+
+	arg, err := p.parse(argMax)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return compound(tk.text, arg), def.priority, nil
+}
+
+func (p *parser) parseInt(tk token, neg bool) (Term, error) {
+	text := tk.text
+	if neg {
+		text = "-" + text
+	}
+	if i, err := strconv.Atoi(text); err == nil {
+		return Integer(i), nil
+	}
+
+	// out of the range of Integer
+	i, ok := new(big.Int).SetString(text, 10)
+	if !ok {
+		return nil, p.errorf(tk, "invalid integer %s", text)
+	}
+	return Big(i), nil
+}
+
+func (p *parser) parseFloat(tk token, neg bool) (Term, error) {
+	text := tk.text
+	if neg {
+		text = "-" + text
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return nil, p.errorf(tk, "invalid float %s", text)
+	}
+	return Float(f), nil
+}
+
+func (p *parser) parseRat(tk token, neg bool) (Term, error) {
+	text := tk.text
+	if neg {
+		text = "-" + text
+	}
+	num, den, _ := strings.Cut(text, "r")
+	r, ok := new(big.Rat).SetString(num + "/" + den)
+	if !ok {
+		return nil, p.errorf(tk, "invalid rational %s", text)
+	}
+	return Rat(r), nil
+}
+
+// parseList parses the list after the opening bracket.
+func (p *parser) parseList() (Term, error) {
+	tk, err := p.lx.peek()
+	if err != nil {
+		return nil, err
+	}
+	if tk.isPunct("]") {
+		p.lx.next()
+		return L(), nil
+	}
+
+	var els List
+	for {
+		el, err := p.parse(999)
+		if err != nil {
+			return nil, err
+		}
+		els = append(els, el)
+
+		if tk, err = p.lx.next(); err != nil {
+			return nil, err
+		}
+		switch {
+		case tk.isPunct(","):
+			continue
+
+		case tk.isPunct("]"):
+			return els, nil
+
+		case tk.isPunct("|"):
+			tail, err := p.parse(999)
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect("]"); err != nil {
+				return nil, err
+			}
+			if tl, ok := tail.(List); ok {
+				return append(els, tl...), nil
+			}
+			for i := len(els) - 1; i >= 0; i-- {
+				tail = HeadTail{Head: els[i], Tail: tail}
+			}
+			return tail, nil
+		}
+
+		return nil, p.errorf(tk, "expected \",\", \"|\" or \"]\" but found %v", tk)
+	}
+}
+
+func (p *parser) variable(name string) Term {
+	if name == "_" {
+		// anonymous variable, different for each occurrence
+		return genUniqueVar()
+	}
+
+	return V(name)
+}
+
+// compound creates a term with name as the functor. Buildin operators are
+// converted into *buildin2.
+func compound(name string, args ...Term) Term {
+	if len(args) == 2 {
+		if op, ok := opOfName(name); ok {
+			return &buildin2{Op: op, L: args[0], R: args[1]}
+		}
+	}
+	return &ComplexTerm{Functor: A(name), Args: args}
+}
+
+/* Conversions from terms to goals and rules */
+
+func isCallable(t Term) bool {
+	switch t.(type) {
+	case atom, *ComplexTerm:
+		return true
+	}
+	return false
+}
+
+// toGoal converts a parsed term into a goal.
+func toGoal(t Term) (Goal, error) {
+	switch g := t.(type) {
+	case atom:
+		switch g.String() {
+		case "true":
+			return And(), nil
+		case "fail", "false":
+			return Or(), nil
+		case "!":
+			return Cut(), nil
+		}
+		return &ComplexTerm{Functor: g}, nil
+
+	case *ComplexTerm:
+		if len(g.Args) == 2 {
+			switch g.Functor.String() {
+			case ",":
+				goals, err := toGoals(g)
+				return And(goals...), err
+			case ";":
+				if cond, ok := isIfArrow(g.Args[0]); ok {
+					return toIfGoal(cond, g.Args[1])
+				}
+				goals, err := toGoals(g)
+				return Or(goals...), err
+			case "->", "*->":
+				return toIfGoal(g, nil)
+			case "=":
+				return Eq(g.Args[0], g.Args[1]), nil
+			case "\\=":
+				return NotEq(g.Args[0], g.Args[1]), nil
+			}
+		}
+		if len(g.Args) == 1 {
+			switch g.Functor.String() {
+			case "\\+", "not":
+				sub, err := toGoal(g.Args[0])
+				if err != nil {
+					return nil, err
+				}
+				return Not(sub), nil
+			case "throw":
+				return Throw(g.Args[0]), nil
+			}
+		}
+		if len(g.Args) == 3 && g.Functor.String() == "catch" {
+			goal, err := toGoal(g.Args[0])
+			if err != nil {
+				return nil, err
+			}
+			recovery, err := toGoal(g.Args[2])
+			if err != nil {
+				return nil, err
+			}
+			return Catch(goal, g.Args[1], recovery), nil
+		}
+		return g, nil
+
+	case *buildin2:
+		return g, nil
+
+	case variable:
+		// proved as call(G), with the value of G when it is called
+		return &ComplexTerm{Functor: A("call"), Args: []Term{g}}, nil
+	}
+
+	return nil, typeError("callable", t, nil)
+}
+
+// toGoals flattens a right-nested ','/2 or ';'/2 term into goals.
+func toGoals(ct *ComplexTerm) ([]Goal, error) {
+	var goals []Goal
+	for {
+		g, err := toGoal(ct.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		goals = append(goals, g)
+
+		next, ok := ct.Args[1].(*ComplexTerm)
+		if !ok || next.Functor != ct.Functor || len(next.Args) != 2 {
+			break
+		}
+		if _, ok := isIfArrow(next.Args[0]); ok {
+			// (a ; b -> c ; d) is (a ; (b -> c ; d))
+			break
+		}
+		ct = next
+	}
+
+	g, err := toGoal(ct.Args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return append(goals, g), nil
+}
+
+// isIfArrow returns the term if t is either (Cond -> Then) or (Cond *-> Then)
+func isIfArrow(t Term) (*ComplexTerm, bool) {
+	if ct, ok := t.(*ComplexTerm); ok && len(ct.Args) == 2 {
+		switch ct.Functor.String() {
+		case "->", "*->":
+			return ct, true
+		}
+	}
+	return nil, false
+}
+
+// toIfGoal converts arrow, i.e. (Cond -> Then) or (Cond *-> Then), and els
+// into an *IfGoal. els can be nil.
+func toIfGoal(arrow *ComplexTerm, els Term) (Goal, error) {
+	cond, err := toGoal(arrow.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	then, err := toGoal(arrow.Args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	ig := &IfGoal{Cond: cond, Then: then, Soft: arrow.Functor.String() == "*->"}
+	if els != nil {
+		if ig.Else, err = toGoal(els); err != nil {
+			return nil, err
+		}
+	}
+	return ig, nil
+}
+
+// toHead converts a parsed term into the head of a rule.
+func toHead(t Term) (*ComplexTerm, error) {
+	switch h := t.(type) {
+	case atom:
+		return &ComplexTerm{Functor: h}, nil
+	case *ComplexTerm:
+		return h, nil
+	case variable:
+		return nil, instantiationError(nil)
+	}
+	return nil, typeError("callable", t, nil)
+}
+
+// isDirective returns the goal term if t is a directive like :- Goal.
+func isDirective(t Term) (Term, bool) {
+	if ct, ok := t.(*ComplexTerm); ok && len(ct.Args) == 1 &&
+		ct.Functor.String() == ":-" {
+		return ct.Args[0], true
+	}
+	return nil, false
+}
+
+// toRule converts a parsed term into a rule.
+func toRule(t Term) (*Rule, error) {
+	if ct, ok := t.(*ComplexTerm); ok && len(ct.Args) == 2 &&
+		ct.Functor.String() == ":-" {
+		head, err := toHead(ct.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		body, err := toGoal(ct.Args[1])
+		if err != nil {
+			return nil, err
+		}
+		return &Rule{Head: head, Body: body}, nil
+	}
+
+	head, err := toHead(t)
+	if err != nil {
+		return nil, err
+	}
+	return &Rule{Head: head}, nil
+}
+
+// goalTerm converts goal back to a term, the reverse of toGoal.
+func goalTerm(goal Goal) Term {
+	switch g := goal.(type) {
+	case ConjGoal:
+		if len(g) == 0 {
+			return A("true")
+		}
+		t := goalTerm(g[len(g)-1])
+		for i := len(g) - 2; i >= 0; i-- {
+			t = compound(",", goalTerm(g[i]), t)
+		}
+		return t
+
+	case DisjGoal:
+		if len(g) == 0 {
+			return A("fail")
+		}
+		t := goalTerm(g[len(g)-1])
+		for i := len(g) - 2; i >= 0; i-- {
+			t = compound(";", goalTerm(g[i]), t)
+		}
+		return t
+
+	case *IfGoal:
+		arrow := "->"
+		if g.Soft {
+			arrow = "*->"
+		}
+		t := compound(arrow, goalTerm(g.Cond), goalTerm(g.Then))
+		if g.Else != nil {
+			t = compound(";", t, goalTerm(g.Else))
+		}
+		return t
+
+	case *NotGoal:
+		return compound("\\+", goalTerm(g.Goal))
+
+	case *CatchGoal:
+		return compound("catch", goalTerm(g.Goal), g.Catcher,
+			goalTerm(g.Recovery))
+
+	case *ThrowGoal:
+		return compound("throw", g.Ball)
+
+	case *MatchGoal:
+		if g.Neg {
+			return compound("\\=", g.L, g.R)
+		}
+		return compound("=", g.L, g.R)
+
+	case cutGoal:
+		return A("!")
+
+	case *ComplexTerm:
+		if len(g.Args) == 0 {
+			return g.Functor
+		}
+		return g
+
+	case *buildin2:
+		return g
+	}
+
+	panic(typeError("callable", A(fmt.Sprint(goal)), nil))
+}
+
+/* Public API */
+
+// ParseTerm parses a single term from s. The ending dot is optional.
+func ParseTerm(s string) (Term, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasSuffix(s, ".") ||
+		len(s) > 1 && isSymbolChar(rune(s[len(s)-2])) {
+		s += " ."
+	}
+
+	p := newParser(strings.NewReader(s))
+	t, err := p.readClause()
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, &SyntaxError{Line: 1, Column: 1, Msg: "empty term"}
+	}
+
+	tk, err := p.lx.next()
+	if err != nil {
+		return nil, err
+	}
+	if tk.kind != tkEOF {
+		return nil, p.errorf(tk, "unexpected %v after the term", tk)
+	}
+
+	return t, nil
+}
+
+// ParseGoal parses a single goal, e.g. a query, from s.
+func ParseGoal(s string) (Goal, error) {
+	t, err := ParseTerm(s)
+	if err != nil {
+		return nil, err
+	}
+	return toGoal(t)
+}
+
+// ParseClauses parses all clauses from r. Directives are not allowed, use
+// Machine.Consult for programs with directives.
+func ParseClauses(r io.Reader) (rules []*Rule, err error) {
+	p := newParser(r)
+	for {
+		t, err := p.readClause()
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			return rules, nil
+		}
+
+		if _, ok := isDirective(t); ok {
+			return nil, fmt.Errorf("directive is not supported: %v", t)
+		}
+
+		rule, err := toRule(t)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+}
@@ -2,7 +2,12 @@ package plg
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
 )
 
 /*
@@ -30,6 +35,10 @@ const (
 	gtIf             // If()Then()Else()
 	gtIs             //  X is Y
 	gtOp             //  X op Y
+	gtCut            // !
+	gtNot            // \+ Goal
+	gtCatch          // catch(Goal, Catcher, Recovery)
+	gtThrow          // throw(Ball)
 )
 
 type Goal interface {
@@ -90,6 +99,23 @@ func Or(goals ...Goal) DisjGoal {
 	return DisjGoal(goals)
 }
 
+func (dg DisjGoal) String() string {
+	if len(dg) == 0 {
+		return "fail"
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("(\n")
+	for i, g := range dg {
+		if i > 0 {
+			buf.WriteString("\n;\n")
+		}
+		buf.WriteString(appendIndent(fmt.Sprint(g), "    "))
+	}
+	buf.WriteString("\n)")
+	return buf.String()
+}
+
 func (dg DisjGoal) GoalType() int {
 	return gtDisj
 }
@@ -122,7 +148,7 @@ func (ct *ComplexTerm) GoalType() int {
 }
 
 func (ct *ComplexTerm) replaceGoalVars(bds VarBindings) Goal {
-	newCt := &ComplexTerm{Functor: ct.Functor, Args: make([]Term, len(ct.Args))}
+	newCt := &ComplexTerm{Functor: bds.atom(ct.Functor), Args: make([]Term, len(ct.Args))}
 	for i, arg := range ct.Args {
 		newCt.Args[i] = arg.replaceVars(bds)
 	}
@@ -146,16 +172,237 @@ func (b *buildin2) singleSolution() bool {
 	return true
 }
 
+/* If-then-else goals */
+
+type IfGoal struct {
+	Cond, Then, Else Goal
+	// soft-cut(*->): Then is proved for all the solutions of Cond
+	Soft bool
+}
+
+// IfThenElse returns the goal (cond -> then ; els). It commits to the first
+// solution of cond and proves then, or proves els if cond fails.
+func IfThenElse(cond, then, els Goal) *IfGoal {
+	return &IfGoal{Cond: cond, Then: then, Else: els}
+}
+
+// IfThen returns the goal (cond -> then), which fails if cond fails.
+func IfThen(cond, then Goal) *IfGoal {
+	return &IfGoal{Cond: cond, Then: then}
+}
+
+// SoftIfThenElse returns the goal (cond *-> then ; els). then is proved for
+// every solution of cond, and els is proved only if cond has no solution.
+// els can be nil.
+func SoftIfThenElse(cond, then, els Goal) *IfGoal {
+	return &IfGoal{Cond: cond, Then: then, Else: els, Soft: true}
+}
+
+func (ig *IfGoal) String() string {
+	arrow := "->"
+	if ig.Soft {
+		arrow = "*->"
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("(\n")
+	buf.WriteString(appendIndent(fmt.Sprint(ig.Cond), "    "))
+	buf.WriteString("\n" + arrow + "\n")
+	buf.WriteString(appendIndent(fmt.Sprint(ig.Then), "    "))
+	if ig.Else != nil {
+		buf.WriteString("\n;\n")
+		buf.WriteString(appendIndent(fmt.Sprint(ig.Else), "    "))
+	}
+	buf.WriteString("\n)")
+	return buf.String()
+}
+
+func (ig *IfGoal) GoalType() int {
+	return gtIf
+}
+
+func (ig *IfGoal) replaceGoalVars(bds VarBindings) Goal {
+	newIg := &IfGoal{Cond: ig.Cond.replaceGoalVars(bds),
+		Then: ig.Then.replaceGoalVars(bds), Soft: ig.Soft}
+	if ig.Else != nil {
+		newIg.Else = ig.Else.replaceGoalVars(bds)
+	}
+	return newIg
+}
+
+func (ig *IfGoal) singleSolution() bool {
+	return false
+}
+
+/* Negation as failure: *NotGoal */
+
+type NotGoal struct {
+	Goal Goal
+}
+
+// Not returns the goal \+ goal, which succeeds without bindings if goal has no
+// solution, and fails otherwise.
+func Not(goal Goal) *NotGoal {
+	return &NotGoal{Goal: goal}
+}
+
+func (ng *NotGoal) String() string {
+	return "\\+ (" + fmt.Sprint(ng.Goal) + ")"
+}
+
+func (ng *NotGoal) GoalType() int {
+	return gtNot
+}
+
+func (ng *NotGoal) replaceGoalVars(bds VarBindings) Goal {
+	return &NotGoal{Goal: ng.Goal.replaceGoalVars(bds)}
+}
+
+func (ng *NotGoal) singleSolution() bool {
+	return true
+}
+
+/* Exception handling: *CatchGoal, *ThrowGoal */
+
+type CatchGoal struct {
+	Goal     Goal
+	Catcher  Term
+	Recovery Goal
+}
+
+// Catch returns the goal catch(goal, catcher, recovery). It proves goal, and
+// if a ball is thrown while proving it, the bindings are undone and recovery
+// is proved if the ball matches catcher. Otherwise the ball is thrown on.
+// Cuts in goal and recovery are local.
+func Catch(goal Goal, catcher interface{}, recovery Goal) *CatchGoal {
+	return &CatchGoal{Goal: goal, Catcher: term(catcher), Recovery: recovery}
+}
+
+func (cg *CatchGoal) String() string {
+	return fmt.Sprintf("catch(%v, %v, %v)", cg.Goal, cg.Catcher, cg.Recovery)
+}
+
+func (cg *CatchGoal) GoalType() int {
+	return gtCatch
+}
+
+func (cg *CatchGoal) replaceGoalVars(bds VarBindings) Goal {
+	return &CatchGoal{Goal: cg.Goal.replaceGoalVars(bds),
+		Catcher: cg.Catcher.replaceVars(bds),
+		Recovery: cg.Recovery.replaceGoalVars(bds)}
+}
+
+func (cg *CatchGoal) singleSolution() bool {
+	return false
+}
+
+type ThrowGoal struct {
+	Ball Term
+}
+
+// Throw returns the goal throw(ball), which throws a copy of ball to the
+// innermost catch/3 whose catcher matches it. An uncaught ball stops the query
+// as a *PrologError.
+func Throw(ball interface{}) *ThrowGoal {
+	return &ThrowGoal{Ball: term(ball)}
+}
+
+func (tg *ThrowGoal) String() string {
+	return fmt.Sprintf("throw(%v)", tg.Ball)
+}
+
+func (tg *ThrowGoal) GoalType() int {
+	return gtThrow
+}
+
+func (tg *ThrowGoal) replaceGoalVars(bds VarBindings) Goal {
+	return &ThrowGoal{Ball: tg.Ball.replaceVars(bds)}
+}
+
+func (tg *ThrowGoal) singleSolution() bool {
+	return true
+}
+
+/* Cut goal: Cut */
+
+type cutGoal struct{}
+
+// Cut returns the cut goal(!). It prunes the remaining clauses of the parent
+// predicate, and the choice points of the goals to its left in the body.
+func Cut() Goal {
+	return cutGoal{}
+}
+
+func (cg cutGoal) String() string {
+	return "!"
+}
+
+func (cg cutGoal) GoalType() int {
+	return gtCut
+}
+
+func (cg cutGoal) replaceGoalVars(bds VarBindings) Goal {
+	return cg
+}
+
+func (cg cutGoal) singleSolution() bool {
+	return true
+}
+
+// cutBarrier counts the cuts executed in a clause body (or a query). A
+// choice point checks whether a cut is executed after itself by comparing the
+// count before and after proving the goals on its right.
+//
+// The count is only accessed by the goroutine of one step at a time, which
+// is serialized by the solution streams.
+type cutBarrier struct {
+	count int
+}
+
 /* Term match goals */
 
 type MatchGoal struct {
 	L, R Term
+	// \=, succeeds if L and R do not match
+	Neg bool
+}
+
+// Eq returns the goal l = r, which matches l and r.
+func Eq(l, r interface{}) *MatchGoal {
+	return &MatchGoal{L: term(l), R: term(r)}
+}
+
+// NotEq returns the goal l \= r, which succeeds if l and r do not match.
+func NotEq(l, r interface{}) *MatchGoal {
+	return &MatchGoal{L: term(l), R: term(r), Neg: true}
+}
+
+func (mg *MatchGoal) String() string {
+	if mg.Neg {
+		return fmt.Sprintf("%v \\= %v", mg.L, mg.R)
+	}
+	return fmt.Sprintf("%v = %v", mg.L, mg.R)
+}
+
+func (mg *MatchGoal) GoalType() int {
+	return gtMatch
+}
+
+func (mg *MatchGoal) replaceGoalVars(bds VarBindings) Goal {
+	return &MatchGoal{L: mg.L.replaceVars(bds), R: mg.R.replaceVars(bds),
+		Neg: mg.Neg}
+}
+
+func (mg *MatchGoal) singleSolution() bool {
+	return true
 }
 
 type Rule struct {
 	Head *ComplexTerm
 	Body Goal
 	vBds rVarBindings
+	// the atoms interned in the atom table of the Machine
+	atoms []atom
 }
 
 func (r Rule) RVarCount() int {
@@ -189,56 +436,308 @@ func (r *Rule) String() string {
 	Machine Type
 *****************/
 
+// Constants for engines proving goals. Used by WithEngine.
+const (
+	// proves goals with goroutines and channels, the default one
+	GoroutineEngine = iota
+	// proves goals by backtracking, without goroutines
+	SequentialEngine
+)
+
+// UnknownFlag is the value of the unknown flag, which decides what happens
+// when an undefined predicate is called. Used by WithUnknown and
+// set_prolog_flag(unknown, Value).
+type UnknownFlag int
+
+// Values of the unknown flag.
+const (
+	// raises existence_error(procedure, Name/Arity), the default one
+	UnknownError UnknownFlag = iota
+	// fails quietly
+	UnknownFail
+	// logs a warning and fails
+	UnknownWarning
+)
+
+var unknownNames = []string{"error", "fail", "warning"}
+
+// Machine is safe for concurrent queries and updates of clauses.
 type Machine struct {
-	rules map[int][]*Rule
+	// guards preds, the predicates in it and atoms
+	lock sync.RWMutex
+	// Key() of the head -> the clauses. A predicate is defined if it is in
+	// preds, even without clauses.
+	preds map[predKey]*predicate
+	// the atoms of the clauses
+	atoms  atomTable
+	engine int
+	// the unknown flag, e.g. UnknownError
+	unknown atomic.Int32
+}
+
+// Option configures a Machine in NewMachine.
+type Option func(m *Machine)
+
+// WithEngine selects the engine proving goals, e.g. SequentialEngine.
+func WithEngine(engine int) Option {
+	return func(m *Machine) {
+		m.engine = engine
+	}
 }
 
-func (m *Machine) AddFact(head *ComplexTerm) {
-	m.AddRule(&Rule{Head: head})
+// WithUnknown sets the unknown flag, e.g. UnknownFail. A value which is not one
+// of the constants is taken as UnknownError.
+func WithUnknown(flag UnknownFlag) Option {
+	if flag < 0 || int(flag) >= len(unknownNames) {
+		flag = UnknownError
+	}
+	return func(m *Machine) {
+		m.unknown.Store(int32(flag))
+	}
 }
 
-func (m *Machine) AddRule(rule *Rule) {
-	fmt.Println(appendIndent(fmt.Sprint(rule), "    ") + "\n")
+// AddFact adds the fact head like AddRule.
+func (m *Machine) AddFact(head *ComplexTerm) error {
+	return m.AddRule(&Rule{Head: head})
+}
 
-	key := rule.Head.Key()
-	m.rules[key] = append(m.rules[key], rule)
+// AddRule adds rule as the last clause of its predicate. If rule has a Go
+// value which cannot be converted to a term, it is not added, and the
+// *PrologError of type_error(term, Type) is returned.
+func (m *Machine) AddRule(rule *Rule) error {
+	if err := m.addRule(rule, false); err != nil {
+		return err
+	}
+	return nil
+}
+
+// addRule adds rule as the last clause of its predicate, or the first one if
+// front is true. An error of an invalid term in rule is returned.
+func (m *Machine) addRule(rule *Rule, front bool) (err *PrologError) {
+	// fmt.Println(appendIndent(fmt.Sprint(rule), "    ") + "\n")
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
-	bds := make(rVarBindings)
-	rule.Head = rule.Head.replaceVars(bds).(*ComplexTerm)
+	bds := &clauseVars{rVarBindings: make(rVarBindings), atoms: m.atoms}
+	defer func() {
+		if err != nil {
+			m.atoms.release(bds.interned)
+		}
+	}()
+	defer recoverError(&err)
+
+	head := rule.Head.replaceVars(bds).(*ComplexTerm)
+	var body Goal
 	if rule.Body != nil {
-		rule.Body = rule.Body.replaceGoalVars(bds)
+		body = rule.Body.replaceGoalVars(bds)
+	}
+	rule.Head, rule.Body = head, body
+	rule.vBds, rule.atoms = bds.rVarBindings, bds.interned
+	// fmt.Println("Replaced:", appendIndent(fmt.Sprint(rule), "    ")+"\n")
+
+	key := rule.Head.Key()
+	pred := m.preds[key]
+	if pred == nil {
+		pred = &predicate{}
+		m.preds[key] = pred
+	}
+	pred.add(rule, front)
+	return nil
+}
+
+// RemoveRule removes rule, which was added by AddRule. Returns false if it is
+// not in the machine. Running queries are not affected.
+func (m *Machine) RemoveRule(rule *Rule) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !m.preds[rule.Head.Key()].remove(rule) {
+		return false
 	}
-	rule.vBds = bds
-	fmt.Println("Replaced:", appendIndent(fmt.Sprint(rule), "    ")+"\n")
+	m.atoms.release(rule.atoms)
+	return true
+}
+
+// Retract removes the first clause whose head matches head. Returns false if
+// no such clause.
+func (m *Machine) Retract(head *ComplexTerm) (ok bool) {
+	// a head with an invalid term matches no clauses
+	var err *PrologError
+	defer recoverError(&err)
+
+	inBds := newPVarBindings(0)
+	lh := head.replaceVars(inBds).(*ComplexTerm)
+	bds := newTrailBindings(inBds.Count)
+
+	mk := bds.mark()
+	rules, _ := m.clauses(lh, bds)
+	for _, rule := range rules {
+		if _, ok := rule.matchHead(lh, bds); ok && m.RemoveRule(rule) {
+			return true
+		}
+		bds.undo(mk)
+	}
+	return false
 }
 
-// returns nil if not matched
-func (r Rule) matchHead(q *ComplexTerm) *Bindings {
-	bds := newBindings(nil, r.RVarCount())
+// Indexes returns the arguments, starting from 1, of the predicate name/arity
+// with an index on them. The first argument is always indexed, others are
+// indexed when calls with them bound are seen.
+func (m *Machine) Indexes(name string, arity int) []int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.preds[keyOf(name, arity)].indexed()
+}
+
+// Dynamic declares the predicate name/arity, so that calling it without
+// clauses fails quietly instead of following the unknown flag.
+func (m *Machine) Dynamic(name string, arity int) {
+	m.dynamic(keyOf(name, arity))
+}
+
+func (m *Machine) dynamic(key predKey) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.preds[key] == nil {
+		m.preds[key] = &predicate{}
+	}
+}
+
+// clauses returns the clauses possibly matching q. The result is not changed
+// by later updates. defined is false if the predicate of q is not defined.
+func (m *Machine) clauses(q *ComplexTerm, bds *Bindings) (rules []*Rule, defined bool) {
+	// First try within read-lock
+	rules, defined, ok := func() ([]*Rule, bool, bool) {
+		m.lock.RLock()
+		defer m.lock.RUnlock()
+
+		pred := m.preds[q.Key()]
+		rules, ok := pred.clauses(q, bds, false)
+		return rules, pred != nil, ok
+	}()
+
+	if ok {
+		return rules, defined
+	}
+
+	// An index has to be built
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	pred := m.preds[q.Key()]
+	rules, _ = pred.clauses(q, bds, true)
+	return rules, pred != nil
+}
+
+// callClauses returns the clauses to try for a call of q. If the predicate is
+// not defined, the unknown flag is followed.
+func (m *Machine) callClauses(q *ComplexTerm, bds *Bindings) []*Rule {
+	rules, defined := m.clauses(q, bds)
+	if defined {
+		return rules
+	}
+
+	switch UnknownFlag(m.unknown.Load()) {
+	case UnknownError:
+		throwError(existenceError(q.Functor, len(q.Args), nil), bds)
+	case UnknownWarning:
+		log.Printf("Unknown procedure: %v/%d", q.Functor, len(q.Args))
+	}
+	return nil
+}
+
+// abolish removes all the clauses of the predicate with key.
+func (m *Machine) abolish(key predKey) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if pred := m.preds[key]; pred != nil {
+		for _, rule := range pred.rules {
+			m.atoms.release(rule.atoms)
+		}
+		delete(m.preds, key)
+	}
+}
+
+// matchHead renames the variables of the rule to new p-variables in bds, and
+// matches the head with q. Returns the renamed body, which is nil for a fact.
+// The bindings put are not undone if not matched.
+func (r *Rule) matchHead(q *ComplexTerm, bds *Bindings) (body Goal, ok bool) {
+	off := pVarOffset(bds.newVars(r.RVarCount()))
 	for i, headArg := range r.Head.Args {
-		qArg := q.Args[i]
-		if !matchTerm(headArg, qArg, bds) {
-			return nil
+		if !matchTerm(headArg.replaceVars(off), q.Args[i], bds) {
+			return nil, false
 		}
 	}
 
-	return bds
+	if r.Body != nil {
+		body = r.Body.replaceGoalVars(off)
+	}
+	return body, true
 }
 
+// Prove returns a channel of solutions of goal. The channel has to be drained,
+// otherwise the goroutines proving the goal are blocked forever. Use Query to
+// stop before all solutions are received.
+//
+// An error raised when proving the goal is discarded, i.e. the channel is just
+// closed as if there were no more solutions. Use Query or SolutionsContext to
+// see it.
 func (m *Machine) Prove(goal Goal) (solutions chan *Bindings) {
-	return m.prove(goal, nil)
+	q := m.Query(context.Background(), goal)
+	solutions = make(chan *Bindings)
+	go func() {
+		for sln, ok := q.Next(); ok; sln, ok = q.Next() {
+			solutions <- sln
+		}
+		close(solutions)
+	}()
+	return solutions
 }
 
-func makeSolutions(slns ...*Bindings) (solutions chan *Bindings) {
-	solutions = make(chan *Bindings, len(slns))
-	for _, sln := range slns {
-		solutions <- sln
+// Consult reads clauses from r and adds them to the machine. A directive like
+// :- Goal is proved when it is read.
+func (m *Machine) Consult(r io.Reader) error {
+	p := newParser(r)
+	for {
+		t, err := p.readClause()
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			return nil
+		}
+
+		if d, ok := isDirective(t); ok {
+			goal, err := toGoal(d)
+			if err != nil {
+				return err
+			}
+			q := m.Query(context.Background(), goal)
+			_, succ := q.Next()
+			q.Close()
+			if err := q.Err(); err != nil {
+				return err
+			}
+			if !succ {
+				return fmt.Errorf("directive failed: %v", d)
+			}
+			continue
+		}
+
+		rule, err := toRule(t)
+		if err != nil {
+			return err
+		}
+		m.AddRule(rule)
 	}
-	close(solutions)
-	return solutions
 }
 
-func (m *Machine) process(goal Goal, bds *Bindings) bool {
+// process proves a goal with at most one solution. Returns false for failure.
+func (m *Machine) process(ctx context.Context, goal Goal, bds *Bindings, cut *cutBarrier) bool {
 	switch goal.GoalType() {
 	case gtConj:
 		cg := goal.(ConjGoal)
@@ -248,70 +747,102 @@ func (m *Machine) process(goal Goal, bds *Bindings) bool {
 		}
 
 		for _, g := range cg {
-			if !m.process(g, bds) {
+			if !m.process(ctx, g, bds, cut) {
 				return false
 			}
 		}
 		return true
 
-	case gtOp:
-		bi := goal.(*buildin2)
-		L, R := bi.L.unify(bds), bi.R.unify(bds)
+	case gtDisj:
+		dg := goal.(DisjGoal)
+		if len(dg) == 0 {
+			// failure
+			return false
+		}
+		return m.process(ctx, dg[0], bds, cut)
 
-		switch bi.Op {
-		case opGt, opGe, opLt, opLe, opNe:
-			// comparing operators
-			if L.Type() == ttInt && R.Type() == ttInt {
-				l, r := L.(Integer), R.(Integer)
-				bl := false
-				switch bi.Op {
-				case opGt:
-					bl = l > r
-				case opGe:
-					bl = l >= r
-				case opLt:
-					bl = l < r
-				case opLe:
-					bl = l <= r
-				case opNe:
-					bl = l != r
-				}
+	case gtCut:
+		cut.count++
+		return true
 
-				if bl {
-					return true
-				}
-				return false
-			}
+	case gtThrow:
+		throwBall(goal.(*ThrowGoal).Ball, bds)
+
+	case gtNot:
+		ng := goal.(*NotGoal)
+		// bindings in Goal are dropped, and cuts in it are local
+		mk := bds.mark()
+		slns := m.prove(ctx, ng.Goal, bds, &cutBarrier{})
+		_, ok := slns.next()
+		// stop searching once a solution is found
+		slns.close()
+		bds.undo(mk)
+		return !ok
+
+	case gtMatch, gtOp:
+		return evalBuiltin(goal, bds)
+	}
 
-			return false
+	panic(fmt.Sprint(goal) + " is not singleSolution!")
+}
 
-		case opIs:
-			r := computeTerm(R)
-			if !matchTerm(L, r, bds) {
-				return false
+// evalBuiltin proves a buildin goal, i.e. a *MatchGoal or a *buildin2, which
+// has at most one solution. Returns false for failure.
+func evalBuiltin(goal Goal, bds *Bindings) bool {
+	switch goal.GoalType() {
+	case gtMatch:
+		mg := goal.(*MatchGoal)
+		if mg.Neg {
+			// bindings are dropped
+			mk := bds.mark()
+			ok := matchTerm(mg.L, mg.R, bds)
+			bds.undo(mk)
+			return !ok
+		}
+		return matchTerm(mg.L, mg.R, bds)
+
+	case gtOp:
+		bi := goal.(*buildin2)
+		switch bi.Op {
+		case opGt, opGe, opLt, opLe, opNe, opEq:
+			// comparing operators, on the values of both sides
+			c := compareNum(eval(bi.L, bds), eval(bi.R, bds))
+			switch bi.Op {
+			case opGt:
+				return c > 0
+			case opGe:
+				return c >= 0
+			case opLt:
+				return c < 0
+			case opLe:
+				return c <= 0
+			case opEq:
+				return c == 0
 			}
+			return c != 0
 
-			// fmt.Println(indent, "opIs", bi, ",", L, "is", R, "=", r, "=>", newBds)
-			return true
+		case opIs:
+			return matchTerm(bi.L, eval(bi.R, bds), bds)
 		}
 
-		panic(fmt.Sprintf("Op %s is not a valid goal.", bi))
-
+		// e.g. 1 + 2 is not a predicate
+		throwError(existenceError(A(OpNames[bi.Op]), 2, nil), bds)
+		return false
 	}
 
-	panic(fmt.Sprint(goal) + " is not singleSolution!")
+	panic(fmt.Sprint(goal) + " is not a buildin goal!")
 }
 
-// prove tries prove the goal send solution Bindings to the channel. After all
-// solutions are sent, the channel is closed.
-// return when all solutions are received. Often called in a go routine.
+// prove tries prove the goal and returns a stream of solution Bindings.
 // nil solutions returned means failure.
 //
-// bds: may be changed (put new bindings), the caller should solve the reuse
-//      problem. The caller should not change it after returned.
-// solution: all bindings along with new bindings, i.e. bds + new bindgs, this value
-//           will not be modified later, so can be referenced/modified safely.
-func (m *Machine) prove(goal Goal, bds *Bindings) (solutions chan *Bindings) {
+// bds: the bindings of the proving, new bindings are put into it. A stream
+//      undoes bds back to where goal started before trying the next
+//      alternative, so the caller should ask for solutions in order, and
+//      should not change bds until the stream is asked again.
+// cut: the barrier of the clause body (or the query) where goal is in.
+// solution: always bds, valid until the stream is asked for the next one.
+func (m *Machine) prove(ctx context.Context, goal Goal, bds *Bindings, cut *cutBarrier) *solutionStream {
 	// fmt.Println(indent, "prove:", bds)
 	// fmt.Println(appendIndent(fmt.Sprint(goal), indent))
 	switch goal.GoalType() {
@@ -319,7 +850,7 @@ func (m *Machine) prove(goal Goal, bds *Bindings) (solutions chan *Bindings) {
 		cg := goal.(ConjGoal)
 		start := 0
 		for start < len(cg) && cg[start].singleSolution() {
-			if !m.process(cg[start], bds) {
+			if !m.process(ctx, cg[start], bds, cut) {
 				return nil
 			}
 
@@ -330,7 +861,7 @@ func (m *Machine) prove(goal Goal, bds *Bindings) (solutions chan *Bindings) {
 			return makeSolutions(bds)
 		}
 
-		slns0 := m.prove(cg[start], bds)
+		slns0 := m.prove(ctx, cg[start], bds, cut)
 		start++
 		// fmt.Println(indent, "proved:", bds, slns0)
 		// fmt.Println(appendIndent(fmt.Sprint(cg[0]), indent))
@@ -342,142 +873,259 @@ func (m *Machine) prove(goal Goal, bds *Bindings) (solutions chan *Bindings) {
 			return slns0
 		}
 
-		solutions = make(chan *Bindings)
-		go func() {
-			remains := cg[start:]
-			for sln0 := range slns0 {
-				slns1 := m.prove(remains, newBindingsFrom(sln0))
-				if slns1 != nil {
-					for sln1 := range slns1 {
-						solutions <- sln1
-					}
+		remains := cg[start:]
+		return newStream(ctx, func(yield func(sln *Bindings) bool) {
+			defer slns0.close()
+
+			for _, ok := slns0.next(); ok; _, ok = slns0.next() {
+				cuts := cut.count
+				slns1 := m.prove(ctx, remains, bds, cut)
+				if !slns1.pipe(yield) {
+					return
 				}
-			}
-			close(solutions)
-		}()
 
-		return solutions
+				if cut.count != cuts {
+					// cut in remains, prune choice points of cg[start-1]
+					return
+				}
+			}
+		})
 
-	case gtOp:
-		bi := goal.(*buildin2)
-		L, R := bi.L.unify(bds), bi.R.unify(bds)
+	case gtDisj:
+		dg := goal.(DisjGoal)
+		switch len(dg) {
+		case 0:
+			// failure
+			return nil
+		case 1:
+			return m.prove(ctx, dg[0], bds, cut)
+		}
 
-		switch bi.Op {
-		case opGt, opGe, opLt, opLe, opNe:
-			// comparing operators
-			if L.Type() == ttInt && R.Type() == ttInt {
-				l, r := L.(Integer), R.(Integer)
-				bl := false
-				switch bi.Op {
-				case opGt:
-					bl = l > r
-				case opGe:
-					bl = l >= r
-				case opLt:
-					bl = l < r
-				case opLe:
-					bl = l <= r
-				case opNe:
-					bl = l != r
+		mk := bds.mark()
+		return newStream(ctx, func(yield func(sln *Bindings) bool) {
+			for _, g := range dg {
+				cuts := cut.count
+				// each branch starts from the same bindings
+				bds.undo(mk)
+				slns := m.prove(ctx, g, bds, cut)
+				if !slns.pipe(yield) {
+					return
 				}
 
-				if bl {
-					return makeSolutions(bds)
+				if cut.count != cuts {
+					// cut in the branch, prune the remaining branches
+					return
 				}
+			}
+		})
+
+	case gtIf:
+		ig := goal.(*IfGoal)
+		// cuts in Cond are local to Cond
+		mk := bds.mark()
+		condSlns := m.prove(ctx, ig.Cond, bds, &cutBarrier{})
+		_, ok := condSlns.next()
+		if !ok {
+			if ig.Else == nil {
 				return nil
 			}
+			bds.undo(mk)
+			return m.prove(ctx, ig.Else, bds, cut)
+		}
 
-			return nil
+		if !ig.Soft {
+			// commit to the first solution of Cond
+			condSlns.close()
+			return m.prove(ctx, ig.Then, bds, cut)
+		}
 
-		case opIs:
-			r := computeTerm(R)
-			if !matchTerm(L, r, bds) {
-				return nil
+		return newStream(ctx, func(yield func(sln *Bindings) bool) {
+			defer condSlns.close()
+
+			for ; ok; _, ok = condSlns.next() {
+				cuts := cut.count
+				slns := m.prove(ctx, ig.Then, bds, cut)
+				if !slns.pipe(yield) {
+					return
+				}
+
+				if cut.count != cuts {
+					// cut in Then, prune choice points of Cond
+					return
+				}
 			}
+		})
 
-			// fmt.Println(indent, "opIs", bi, ",", L, "is", R, "=", r, "=>", newBds)
-			return makeSolutions(bds)
+	case gtOp, gtMatch, gtCut, gtNot, gtThrow:
+		if !m.process(ctx, goal, bds, cut) {
+			return nil
 		}
+		return makeSolutions(bds)
 
-		panic(fmt.Sprintf("Op %s is not a valid goal.", bi))
+	case gtCatch:
+		return m.proveCatch(ctx, goal.(*CatchGoal), bds)
 
 	case gtComplex:
 		ct := goal.(*ComplexTerm)
-		ct = ct.unify(bds).(*ComplexTerm)
-
-		return m.match(ct, bds)
+		if ct.Key() == keyCall {
+			// cuts in the goal are local to it
+			return m.prove(ctx, callGoal(ct, bds), bds, &cutBarrier{})
+		}
+		if bi := gBuiltins[ct.Key()]; bi != nil {
+			return m.callBuiltin(ctx, bi, ct, bds)
+		}
+		return m.match(ctx, ct, bds)
 
 	default:
-		panic(fmt.Sprintf("Goal not supported: %s", goal))
+		throwError(typeError("callable", A(fmt.Sprint(goal)), nil), bds)
+		return nil
 	}
-
-	return nil
-}
-
-func calcSolution(qBds *Bindings, inBds *pVarBindings, bds *Bindings) (sln *Bindings) {
-	sln = newBindingsFrom(qBds)
-	inBds.each(func(v, vl variable) {
-		sln.Put(v, vl.export(bds))
-	})
-
-	return sln
 }
 
 // for debugging
 var indent string
 
-func (m *Machine) Match(query *ComplexTerm) (solutions chan *Bindings) {
-	return m.match(query, nil)
+// proveCatch proves catch(Goal, Catcher, Recovery). A ball thrown in the
+// goroutines proving Goal is raised again when its stream is asked, i.e. it is
+// passed up to the stream of the catch.
+func (m *Machine) proveCatch(ctx context.Context, cg *CatchGoal, bds *Bindings) *solutionStream {
+	mk := bds.mark()
+	return newStream(ctx, func(yield func(sln *Bindings) bool) {
+		ball := m.catchBall(ctx, cg.Goal, bds, yield)
+		if ball == nil {
+			return
+		}
+
+		bds.undo(mk)
+		if !matchTerm(cg.Catcher, ball.Term, bds) {
+			// thrown on
+			panic(ball)
+		}
+		m.prove(ctx, cg.Recovery, bds, &cutBarrier{}).pipe(yield)
+	})
 }
 
-// query: has been unified
-// qBds: Bings base of query
-// solution: gV/rV -> const/gV
-func (m *Machine) match(query *ComplexTerm, qBds *Bindings) (solutions chan *Bindings) {
-	/* localized query: query -> lq */
-	// query.gV/rV -> pVas
-	inBds := newPVarBindings(qBds.RVarCount())
+// catchBall yields the solutions of goal, and returns the ball thrown when
+// proving it, or nil if none. All the goroutines proving goal are stopped when
+// it returns.
+func (m *Machine) catchBall(ctx context.Context, goal Goal, bds *Bindings, yield func(sln *Bindings) bool) (ball *PrologError) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer recoverError(&ball)
 
-	lq := query.replaceVars(inBds).(*ComplexTerm)
-	//fmt.Println(indent, "replaceVars", query, "->", lq)
-	//indent += "    "
-	//defer func() { indent = indent[:len(indent)-4] }()
+	m.prove(ctx, goal, bds, &cutBarrier{}).pipe(yield)
+	return nil
+}
 
-	// each solution: query.g/rVars -> const, gVars
-	solutions = make(chan *Bindings)
+// Match returns a channel of solutions of query. Same as Prove, the channel
+// has to be drained, and an error raised is discarded.
+func (m *Machine) Match(query *ComplexTerm) (solutions chan *Bindings) {
+	return m.Prove(query)
+}
 
-	go func() {
-		rules := m.rules[query.Key()]
+// match proves query with the clauses of its predicate. Each clause is tried
+// from the bindings where query started.
+func (m *Machine) match(ctx context.Context, query *ComplexTerm, bds *Bindings) *solutionStream {
+	mk := bds.mark()
+	return newStream(ctx, func(yield func(sln *Bindings) bool) {
+		rules := m.callClauses(query, bds)
 		for _, rule := range rules {
-			hdBds := rule.matchHead(lq)
-			if hdBds == nil {
+			bds.undo(mk)
+			body, ok := rule.matchHead(query, bds)
+			if !ok {
 				// head not matched
 				continue
 			}
-			//fmt.Println(indent, "Head matched:", lq, "<->", rule.Head, "under", hdBds)
 
-			if rule.Body == nil {
+			if body == nil {
 				// For a head-matched fact, generate a single solution.
-				//fmt.Println(indent, lq, "Fact", rule.Head, hdBds)
-				solutions <- calcSolution(qBds, inBds, hdBds)
-				//break
+				if !yield(bds) {
+					return
+				}
 				continue
 			}
 
-			slns := m.prove(rule.Body, hdBds)
-			if slns != nil {
-				for sln := range slns {
-					// fmt.Println(indent, "sln:", sln, hdBds)
-					solutions <- calcSolution(qBds, inBds, sln)
-				}
+			// each clause has its own cut barrier
+			cut := &cutBarrier{}
+			slns := m.prove(ctx, body, bds, cut)
+			if !slns.pipe(yield) {
+				return
+			}
+
+			if cut.count > 0 {
+				// cut in the body, prune remaining clauses
+				return
 			}
 		}
-		close(solutions)
-	}()
+	})
+}
 
-	return solutions
+// Key() of call/1
+var keyCall = keyOf("call", 1)
+
+// callGoal returns the goal of call(G), which is converted from the value of G
+// in bds.
+func callGoal(call *ComplexTerm, bds *Bindings) Goal {
+	ctx := indicator(A("call"), 1)
+	t := bds.unifyVar(call.Args[0])
+	if t.Type() == ttVar {
+		throwError(instantiationError(ctx), bds)
+	}
+	goal, err := toGoal(t)
+	if err != nil {
+		// the culprit is the whole goal
+		throwError(typeError("callable", t, ctx), bds)
+	}
+	return goal
+}
+
+// callBuiltin proves a call of a builtin predicate.
+func (m *Machine) callBuiltin(ctx context.Context, bi *builtinPred, call *ComplexTerm, bds *Bindings) *solutionStream {
+	if bi.det != nil {
+		if !bi.det(m, call.Args, bds) {
+			return nil
+		}
+		return makeSolutions(bds)
+	}
+	if bi.detCtx != nil {
+		if !bi.detCtx(ctx, m, call.Args, bds) {
+			return nil
+		}
+		return makeSolutions(bds)
+	}
+
+	mk := bds.mark()
+	alts := bi.nondet(m, call.Args, bds)
+	return newStream(ctx, func(yield func(sln *Bindings) bool) {
+		for _, alt := range alts {
+			bds.undo(mk)
+			if alt() && !yield(bds) {
+				return
+			}
+		}
+	})
 }
 
-func NewMachine() *Machine {
-	return &Machine{rules: make(map[int][]*Rule)}
+// once proves goal with the engine of m, and puts the bindings of its first
+// solution into bds. Returns false if it fails or ctx is done. Cuts in goal are
+// local to it.
+func (m *Machine) once(ctx context.Context, goal Goal, bds *Bindings) bool {
+	var slns solver
+	if m.engine == SequentialEngine {
+		slns = m.newSeqEngine(ctx, goal, bds)
+	} else {
+		slns = m.prove(ctx, goal, bds, &cutBarrier{})
+	}
+	defer slns.close()
+
+	_, ok := slns.next()
+	return ok
+}
+
+func NewMachine(opts ...Option) *Machine {
+	m := &Machine{preds: make(map[predKey]*predicate), atoms: make(atomTable)}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
 }
@@ -1,8 +1,15 @@
 package plg
 
 import (
+	"context"
 	"fmt"
+	"math/big"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func ctFunc(name string) func(args ...interface{}) *ComplexTerm {
@@ -310,7 +317,7 @@ func grid(M, N, Z interface{}, bds map[string]interface{}) chan map[string]inter
 				n = bds[N.(string)].(int)
 				<-slns1
 
-				var M1 interface{} = string(genUniqueVar())
+				var M1 interface{} = fmt.Sprint(genUniqueVar())
 				bds[M1.(string)] = bds[M.(string)].(int) - 1
 				slns2 := make(chan map[string]interface{}, 1)
 				slns2 <- nil
@@ -319,14 +326,14 @@ func grid(M, N, Z interface{}, bds map[string]interface{}) chan map[string]inter
 					<-slns2
 
 					go func() { // grid(M1, N, Z1)
-						var Z1 interface{} = string(genUniqueVar())
+						var Z1 interface{} = fmt.Sprint(genUniqueVar())
 						z1 := grid(M1, N, Z1, bds)
 						go func() { // N1 is N - 1
 							bds[Z1.(string)] = (<-z1)[Z1.(string)]
 
-							var N1 interface{} = string(genUniqueVar())
+							var N1 interface{} = fmt.Sprint(genUniqueVar())
 							bds[N1.(string)] = bds[N.(string)].(int) - 1
-							var Z2 interface{} = string(genUniqueVar())
+							var Z2 interface{} = fmt.Sprint(genUniqueVar())
 							z2 := grid(M, N1, Z2, bds)
 							go func() { // grid(M, N1, Z2)
 								bds[Z2.(string)] = (<-z2)[Z2.(string)]
@@ -381,3 +388,1680 @@ func TestReplaceVars(t *testing.T) {
 	fmt.Println(r, rBds)
 	assertCount(t, 3, len(rBds))
 }
+
+func TestBindingsUndo(t *testing.T) {
+	f := ctFunc("f")
+	bds := newTrailBindings(2)
+	P0, P1 := pV(0), pV(1)
+	if !matchTerm(P0, f(P1), bds) {
+		t.Fatalf("Expected matched")
+	}
+
+	mk := bds.mark()
+	base := bds.newVars(1)
+	assertCount(t, 2, base)
+	if !matchTerm(f(pV(base)), P0, bds) || !matchTerm(pV(base), I(1), bds) {
+		t.Fatalf("Expected matched")
+	}
+	fmt.Println(bds)
+	if vl := P0.unify(bds); fmt.Sprint(vl) != "f(1)" {
+		t.Errorf("Expected f(1), got %v", vl)
+	}
+
+	bds.undo(mk)
+	fmt.Println(bds)
+	assertCount(t, 2, len(bds.pList))
+	if vl := P0.unify(bds); fmt.Sprint(vl) != "f(P_1)" {
+		t.Errorf("Expected f(P_1), got %v", vl)
+	}
+
+	// unbound variables are exported as the same new variable
+	sln, ok := NewMachine().Query(context.Background(),
+		And(Eq(X, Y), Eq(Z, f(Y)))).Next()
+	if !ok {
+		t.Fatalf("Expected a solution")
+	}
+	fmt.Println(sln)
+	if x, y := sln.Get(V(X)), sln.Get(V(Y)); x == nil || x != y || x == Term(V(X)) {
+		t.Errorf("Expected X, Y bound to the same new variable: %v", sln)
+	}
+	if z := sln.Get(V(Z)); fmt.Sprint(z) != fmt.Sprintf("f(%v)", sln.Get(V(X))) {
+		t.Errorf("Expected Z = f(X): %v", sln)
+	}
+}
+
+func TestParseTerm(t *testing.T) {
+	for _, c := range []struct {
+		src, exp string
+	}{
+		{"foo", "foo"},
+		{"'hello world'", "hello world"},
+		{"f(X, _Y, a)", "f(X, _Y, a)"},
+		{"[1, 2, 3]", "[1 2 3]"},
+		{"[H|T]", "[H|T]"},
+		{"[a, b|T]", "[a|[b|T]]"},
+		{"[a|[b, c]]", "[a b c]"},
+		{"X is N - 1", "X is N - 1"},
+		{"X is 1 + 2 * 3", "X is 1 + 2 * 3"},
+		{"X is (1 + 2) * 3", "X is 1 + 2 * 3"},
+		// aliases of Op are ordinary atoms
+		{"'<='(1, 2)", "<=(1, 2)"},
+		{"'=>'(a, b)", "=>(a, b)"},
+		{"'!='(a, b)", "!=(a, b)"},
+		{"'=<'(1, 2)", "1 =< 2"},
+		{"X =< 2", "X =< 2"},
+		{"X =\\= 2", "X =\\= 2"},
+		{"-1", "-1"},
+		{"- 1", "-(1)"},
+		{"0'a", "97"},
+		{"0x1F", "31"},
+		{"\"ab\"", "[97 98]"},
+		{"X = f(Y)", "=(X, f(Y))"},
+		{"a :- b, c ; d", ":-(a, ;(,(b, c), d))"},
+		{"\\+ a", "\\+(a)"},
+		{"X = (\\+ a)", "=(X, \\+(a))"},
+		{"'\\n'", "\n"},
+	} {
+		tm, err := ParseTerm(c.src)
+		if err != nil {
+			t.Errorf("ParseTerm(%q) failed: %v", c.src, err)
+			continue
+		}
+		if act := fmt.Sprint(tm); act != c.exp {
+			t.Errorf("ParseTerm(%q): expected %q, got %q", c.src, c.exp, act)
+		}
+	}
+
+	tm, _ := ParseTerm("X is (1 + 2) * 3")
+	r := tm.(*buildin2).R.(*buildin2)
+	if r.Op != opMul || r.L.(*buildin2).Op != opPlus {
+		t.Errorf("Wrong priority: %v", tm)
+	}
+
+	for _, src := range []string{"f(", "[a|b|c]", "a b", "'abc", "f(a))",
+		"X = \\+ a", "- :- a"} {
+		if _, err := ParseTerm(src); err == nil {
+			t.Errorf("ParseTerm(%q) should fail", src)
+		}
+	}
+}
+
+func TestConsult(t *testing.T) {
+	m := NewMachine()
+	err := m.Consult(strings.NewReader(`
+% facts
+parent(david, xiaoxi).
+parent(laotaiye, david).
+parent(laolaotaiye, laotaiye).
+
+/* rules */
+descendant(X, Y) :- parent(X, Y).
+descendant(X, Y) :-
+	parent(X, Z),
+	descendant(Z, Y).
+
+reverse([], X, X).
+reverse([X|Y], Z, W) :- reverse(Y, [X|Z], W).
+
+factorial(0, 1).
+factorial(N, F) :-
+	N > 0,
+	N1 is N - 1,
+	factorial(N1, F1),
+	F is N * F1.
+`))
+	if err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	parent := ctFunc("parent")
+	descendant := ctFunc("descendant")
+	reverse := ctFunc("reverse")
+	factorial := ctFunc("factorial")
+
+	assertCount(t, 3, match(m, parent(X, Y)))
+	assertCount(t, 6, match(m, descendant(P, Q)))
+	assertCount(t, 1, match(m, reverse(L("1", "2", "3"), L(), X)))
+
+	vl := calcInt(m, factorial(5, X), V(X))
+	if len(vl) != 1 || vl[0] != 120 {
+		t.Errorf("Expected [120], got %v", vl)
+	}
+
+	goal, err := ParseGoal("descendant(laolaotaiye, W), parent(W, xiaoxi)")
+	if err != nil {
+		t.Fatalf("ParseGoal failed: %v", err)
+	}
+	count := 0
+	for _ = range m.Prove(goal) {
+		count++
+	}
+	assertCount(t, 1, count)
+
+	rules, err := ParseClauses(strings.NewReader("a. b :- a."))
+	if err != nil {
+		t.Fatalf("ParseClauses failed: %v", err)
+	}
+	assertCount(t, 2, len(rules))
+
+	if _, err = ParseClauses(strings.NewReader(":- a.")); err == nil {
+		t.Errorf("ParseClauses should reject directives")
+	}
+}
+
+func TestCall(t *testing.T) {
+	const program = `
+		p(1).
+		p(2).
+		i(X) :- G = p(X), G.
+		once(X) :- G = (p(X), !), G.
+		local(X) :- p(X), G = !, G.
+	`
+	for _, engine := range []int{GoroutineEngine, SequentialEngine} {
+		m := NewMachine(WithEngine(engine))
+		if err := m.Consult(strings.NewReader(program)); err != nil {
+			t.Fatalf("Consult failed: %v", err)
+		}
+
+		for _, c := range []struct {
+			query, exp string
+		}{
+			{"i(X)", "[X=1 X=2]"},
+			{"call(p(X))", "[X=1 X=2]"},
+			{"once(X)", "[X=1]"},
+			// cuts are local to the call
+			{"local(X)", "[X=1 X=2]"},
+			{"catch(G, error(E, _), true)", "[G=_,E=instantiation_error]"},
+			{"catch(call(1), error(E, _), true)", "[E=type_error(callable, 1)]"},
+			{"catch(call((p(X), 1)), error(E, _), true)",
+				"[X=_,E=type_error(callable, ,(p(_), 1))]"},
+		} {
+			if act := fmt.Sprint(answers(t, m, c.query)); act != c.exp {
+				t.Errorf("engine %d: %s: expected %s, got %s", engine, c.query,
+					c.exp, act)
+			}
+		}
+	}
+}
+
+func TestDisjunction(t *testing.T) {
+	m := NewMachine()
+	err := m.Consult(strings.NewReader(`
+q(1).
+q(2).
+r(3).
+
+p(X) :- (q(X) ; r(X)).
+s(X, Y) :- q(X), (r(Y) ; Y is X * 10 ; fail).
+u(X) :- (fail ; q(X)), X > 1.
+`))
+	if err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	p := ctFunc("p")
+	s := ctFunc("s")
+	u := ctFunc("u")
+
+	vl := calcInt(m, p(X), V(X))
+	if fmt.Sprint(vl) != "[1 2 3]" {
+		t.Errorf("Expected [1 2 3], got %v", vl)
+	}
+
+	vl = calcInt(m, s(X, Y), V(Y))
+	if fmt.Sprint(vl) != "[3 10 3 20]" {
+		t.Errorf("Expected [3 10 3 20], got %v", vl)
+	}
+
+	vl = calcInt(m, u(X), V(X))
+	if fmt.Sprint(vl) != "[2]" {
+		t.Errorf("Expected [2], got %v", vl)
+	}
+
+	assertCount(t, 0, match(m, p(4)))
+}
+
+func TestCut(t *testing.T) {
+	m := NewMachine()
+	err := m.Consult(strings.NewReader(`
+q(1).
+q(2).
+q(3).
+r(4).
+
+first(X) :- q(X), !.
+noleft(X, Y) :- q(X), !, q(Y).
+clause(X) :- q(X), X > 1, !.
+clause(0).
+inDisj(X) :- (q(X), X > 1, ! ; r(X)).
+inDisj(0).
+after(X) :- (q(X) ; r(X)), !.
+nested(X) :- q(X), (q(Y), Y > X, !).
+
+factorial(0, 1) :- !.
+factorial(N, F) :-
+	N1 is N - 1,
+	factorial(N1, F1),
+	F is N * F1.
+
+nat(0).
+nat(N) :- nat(M), N is M + 1.
+firstNat(N) :- nat(N), N > 5, !.
+`))
+	if err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	for _, c := range []struct {
+		query *ComplexTerm
+		exp   string
+	}{
+		{ctFunc("first")(X), "[1]"},
+		{ctFunc("noleft")(Y, X), "[1 2 3]"},
+		{ctFunc("clause")(X), "[2]"},
+		{ctFunc("inDisj")(X), "[2]"},
+		{ctFunc("after")(X), "[1]"},
+		{ctFunc("nested")(X), "[1]"},
+		{ctFunc("factorial")(5, X), "[120]"},
+		{ctFunc("firstNat")(X), "[6]"},
+	} {
+		vl := calcInt(m, c.query, V(X))
+		if act := fmt.Sprint(vl); act != c.exp {
+			t.Errorf("%v: expected %s, got %s", c.query, c.exp, act)
+		}
+	}
+
+	// producers of pruned choice points are stopped
+	n := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		calcInt(m, ctFunc("firstNat")(X), V(X))
+	}
+	for i := 0; i < 100 && runtime.NumGoroutine() > n; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if runtime.NumGoroutine() > n {
+		t.Errorf("Goroutines leaked: %d -> %d", n, runtime.NumGoroutine())
+	}
+}
+
+func TestIfThenElse(t *testing.T) {
+	m := NewMachine()
+	err := m.Consult(strings.NewReader(`
+q(1).
+q(2).
+q(3).
+
+sign(X, S) :- ( X > 0 -> S is 1 ; X < 0 -> S is -1 ; S is 0 ).
+firstQ(X) :- ( q(X) -> true ; X is 0 ).
+noElse(X) :- ( q(X), X > 5 -> true ).
+soft(X) :- ( q(X) *-> true ; X is 0 ).
+softElse(X) :- ( fail *-> X is 1 ; X is 0 ).
+cutThen(X) :- q(X), ( X > 1 -> ! ; fail ).
+cutCond(X) :- ( !, fail -> true ; true ), q(X).
+cutCond(9).
+inOr(X) :- ( q(X) ; 0 > 1 -> X is 5 ; X is 6 ).
+`))
+	if err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	for _, c := range []struct {
+		query *ComplexTerm
+		exp   string
+	}{
+		{ctFunc("sign")(5, X), "[1]"},
+		{ctFunc("sign")(-5, X), "[-1]"},
+		{ctFunc("sign")(0, X), "[0]"},
+		{ctFunc("firstQ")(X), "[1]"},
+		{ctFunc("noElse")(X), "[]"},
+		{ctFunc("soft")(X), "[1 2 3]"},
+		{ctFunc("softElse")(X), "[0]"},
+		{ctFunc("cutThen")(X), "[2]"},
+		{ctFunc("cutCond")(X), "[1 2 3 9]"},
+		{ctFunc("inOr")(X), "[1 2 3 6]"},
+	} {
+		vl := calcInt(m, c.query, V(X))
+		if act := fmt.Sprint(vl); act != c.exp {
+			t.Errorf("%v: expected %s, got %s", c.query, c.exp, act)
+		}
+	}
+
+	q := ctFunc("q")
+	max := ctFunc("max")
+	m.AddRule(R(max(X, Y, Z),
+		IfThenElse(Op(X, ">=", Y), Is(Z, X), Is(Z, Y))))
+	vl := calcInt(m, max(3, 7, X), V(X))
+	if fmt.Sprint(vl) != "[7]" {
+		t.Errorf("Expected [7], got %v", vl)
+	}
+
+	count := 0
+	for _ = range m.Prove(IfThen(q(X), Op(X, ">", 1))) {
+		count++
+	}
+	assertCount(t, 0, count)
+}
+
+func TestNot(t *testing.T) {
+	m := NewMachine()
+	err := m.Consult(strings.NewReader(`
+q(1).
+q(2).
+q(3).
+r(2).
+
+notR(X) :- q(X), \+ r(X).
+notQ(X) :- q(X), not(q(4)), \+ (q(Y), Y > X).
+notCut(X) :- q(X), \+ (!, fail).
+
+nat(0).
+nat(N) :- nat(M), N is M + 1.
+big(N) :- \+ \+ (nat(X), X > N).
+`))
+	if err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	for _, c := range []struct {
+		query *ComplexTerm
+		exp   string
+	}{
+		{ctFunc("notR")(X), "[1 3]"},
+		{ctFunc("notQ")(X), "[3]"},
+		{ctFunc("notCut")(X), "[1 2 3]"},
+	} {
+		vl := calcInt(m, c.query, V(X))
+		if act := fmt.Sprint(vl); act != c.exp {
+			t.Errorf("%v: expected %s, got %s", c.query, c.exp, act)
+		}
+	}
+
+	// the infinite producer of nat/1 is stopped after the first solution
+	assertCount(t, 1, match(m, ctFunc("big")(10)))
+
+	q := ctFunc("q")
+	count := 0
+	for _ = range m.Prove(And(Not(q(5)), Not(Not(q(1))))) {
+		count++
+	}
+	assertCount(t, 1, count)
+}
+
+func TestEq(t *testing.T) {
+	m := NewMachine()
+	err := m.Consult(strings.NewReader(`
+q(1).
+q(2).
+
+pair(X, Y, P) :- P = p(X, Y).
+diff(X, Y) :- q(X), q(Y), X \= Y.
+head(L, H) :- L = [H|_].
+`))
+	if err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	pair := ctFunc("pair")
+	p := ctFunc("p")
+	assertCount(t, 1, match(m, pair(1, 2, p(1, X))))
+	assertCount(t, 0, match(m, pair(1, 2, p(2, X))))
+	assertCount(t, 2, match(m, ctFunc("diff")(X, Y)))
+
+	vl := calcInt(m, ctFunc("head")(L(3, 4), X), V(X))
+	if fmt.Sprint(vl) != "[3]" {
+		t.Errorf("Expected [3], got %v", vl)
+	}
+
+	count := 0
+	for sln := range m.Prove(And(Eq(X, p(Y, 2)), Eq(Y, 1), NotEq(X, p(2, 2)))) {
+		count++
+		if act := fmt.Sprint(p(X).unify(sln)); act != "p(p(1, 2))" {
+			t.Errorf("Expected p(p(1, 2)), got %s", act)
+		}
+	}
+	assertCount(t, 1, count)
+}
+
+func TestQuery(t *testing.T) {
+	m := NewMachine()
+	err := m.Consult(strings.NewReader(`
+nat(0).
+nat(N) :- nat(M), N is M + 1.
+negative(X) :- nat(X), X < 0.
+`))
+	if err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	nat := ctFunc("nat")
+
+	n := runtime.NumGoroutine()
+
+	q := m.Query(context.Background(), nat(X))
+	var vl []int
+	for sln, ok := q.Next(); ok && len(vl) < 5; sln, ok = q.Next() {
+		vl = append(vl, int(sln.Get(V(X)).(Integer)))
+	}
+	q.Close()
+	if fmt.Sprint(vl) != "[0 1 2 3 4]" {
+		t.Errorf("Expected [0 1 2 3 4], got %v", vl)
+	}
+	if q.Err() != nil {
+		t.Errorf("Unexpected error: %v", q.Err())
+	}
+	if _, ok := q.Next(); ok {
+		t.Errorf("Closed query should have no solutions")
+	}
+	if runtime.NumGoroutine() > n {
+		t.Errorf("Goroutines leaked after Close: %d -> %d", n,
+			runtime.NumGoroutine())
+	}
+
+	// no solutions at all, stopped by the context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	q = m.Query(ctx, ctFunc("negative")(X))
+	if _, ok := q.Next(); ok {
+		t.Errorf("Expected no solution")
+	}
+	if q.Err() != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded, got %v", q.Err())
+	}
+	for i := 0; i < 100 && runtime.NumGoroutine() > n; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if runtime.NumGoroutine() > n {
+		t.Errorf("Goroutines leaked after cancel: %d -> %d", n,
+			runtime.NumGoroutine())
+	}
+
+	// answers are exported
+	goal, _ := ParseGoal("X = f(Y, Z), Y = 1")
+	q = m.Query(context.Background(), goal)
+	sln, ok := q.Next()
+	if !ok {
+		t.Fatalf("Expected a solution")
+	}
+	if act := fmt.Sprint(sln.Get(V(X))); !strings.HasPrefix(act, "f(1, ") {
+		t.Errorf("Expected f(1, _), got %s", act)
+	}
+	if _, ok = q.Next(); ok {
+		t.Errorf("Expected only one solution")
+	}
+	if q.Err() != nil {
+		t.Errorf("Unexpected error: %v", q.Err())
+	}
+}
+
+func TestSolutions(t *testing.T) {
+	m := NewMachine()
+	err := m.Consult(strings.NewReader(`
+nat(0).
+nat(N) :- nat(M), N is M + 1.
+`))
+	if err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	nat := ctFunc("nat")
+
+	n := runtime.NumGoroutine()
+	var vl []int
+	for sln := range m.Solutions(nat(X)) {
+		vl = append(vl, int(sln.Get(V(X)).(Integer)))
+		if len(vl) == 3 {
+			break
+		}
+	}
+	if fmt.Sprint(vl) != "[0 1 2]" {
+		t.Errorf("Expected [0 1 2], got %v", vl)
+	}
+	if runtime.NumGoroutine() > n {
+		t.Errorf("Goroutines leaked after break: %d -> %d", n,
+			runtime.NumGoroutine())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	count := 0
+	var lastErr error
+	for sln, err := range m.SolutionsContext(ctx, nat(X)) {
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if sln.Get(V(X)) == nil {
+			t.Errorf("X is not bound")
+		}
+		if count++; count == 3 {
+			cancel()
+		}
+	}
+	assertCount(t, 3, count)
+	if lastErr != context.Canceled {
+		t.Errorf("Expected Canceled, got %v", lastErr)
+	}
+}
+
+const testProgram = `
+q(1).
+q(2).
+q(3).
+r(2).
+
+parent(david, xiaoxi).
+parent(laotaiye, david).
+parent(laolaotaiye, laotaiye).
+descendant(X, Y) :- parent(X, Y).
+descendant(X, Y) :- parent(X, Z), descendant(Z, Y).
+
+reverse([], X, X).
+reverse([X|Y], Z, W) :- reverse(Y, [X|Z], W).
+
+factorial(0, 1) :- !.
+factorial(N, F) :- N1 is N - 1, factorial(N1, F1), F is N * F1.
+
+fibonacci(1, 1).
+fibonacci(2, 1).
+fibonacci(N, F) :-
+	N > 2,
+	N1 is N - 1, fibonacci(N1, F1),
+	N2 is N - 2, fibonacci(N2, F2),
+	F is F1 + F2.
+
+grid(_, 0, 1).
+grid(0, _, 1).
+grid(X, Y, Z) :-
+	X > 0, Y > 0,
+	X1 is X - 1, grid(X1, Y, Z1),
+	Y1 is Y - 1, grid(X, Y1, Z2),
+	Z is Z1 + Z2.
+
+nat(0).
+nat(N) :- nat(M), N is M + 1.
+
+append([], L, L).
+append([H|T], L, [H|R]) :- append(T, L, R).
+
+member(X, [X|_]).
+member(X, [_|T]) :- member(X, T).
+
+sign(X, S) :- ( X > 0 -> S = pos ; X < 0 -> S = neg ; S = zero ).
+soft(X, Y) :- ( q(X) *-> Y = X ; Y = none ).
+notR(X) :- q(X), \+ r(X).
+firstNat(N) :- nat(N), N > 5, !.
+cutThen(X) :- q(X), ( X > 1 -> ! ; fail ).
+cutCond(X) :- ( !, fail -> true ; true ), q(X).
+cutCond(9).
+pair(X-Y) :- member(X, [a, b]), member(Y, [c, d]).
+`
+
+var testQueries = []string{
+	"q(X)",
+	"descendant(X, Y)",
+	"reverse([1, 2, 3], [], X)",
+	"factorial(10, X)",
+	"fibonacci(10, X)",
+	"grid(4, 4, X)",
+	"append(X, Y, [1, 2, 3])",
+	"append([1], [2], X), member(Y, X)",
+	"member(X, [a, b, c]), X \\= b",
+	"sign(3, X) ; sign(-3, X) ; sign(0, X)",
+	"soft(X, Y)",
+	"notR(X)",
+	"firstNat(X)",
+	"cutThen(X)",
+	"cutCond(X)",
+	"pair(X)",
+	"X = f(Y, Z), Y = g(Z)",
+	"q(X), !, q(Y)",
+	"(q(X) ; X = 0), X > 1",
+}
+
+// normVars replaces generated variable names so that answers from different
+// engines can be compared.
+var normVarsRe = regexp.MustCompile(`[GP]_[0-9]+`)
+
+func answers(t *testing.T, m *Machine, query string) []string {
+	goal, err := ParseGoal(query)
+	if err != nil {
+		t.Fatalf("ParseGoal(%q) failed: %v", query, err)
+	}
+
+	vc := &varCollector{}
+	goal.replaceGoalVars(vc)
+
+	var res []string
+	for sln := range m.Solutions(goal) {
+		var buf []string
+		for _, v := range vc.vars {
+			buf = append(buf, fmt.Sprintf("%v=%v", v, sln.Get(v)))
+		}
+		res = append(res, normVarsRe.ReplaceAllString(strings.Join(buf, ","), "_"))
+	}
+	return res
+}
+
+func TestEngines(t *testing.T) {
+	gm := NewMachine()
+	sm := NewMachine(WithEngine(SequentialEngine))
+	for _, m := range []*Machine{gm, sm} {
+		if err := m.Consult(strings.NewReader(testProgram)); err != nil {
+			t.Fatalf("Consult failed: %v", err)
+		}
+	}
+
+	for _, query := range testQueries {
+		exp := answers(t, gm, query)
+		act := answers(t, sm, query)
+		if len(exp) == 0 {
+			t.Errorf("%s: no solutions", query)
+		}
+		if fmt.Sprint(exp) != fmt.Sprint(act) {
+			t.Errorf("%s: goroutine engine: %v, sequential engine: %v",
+				query, exp, act)
+		}
+	}
+
+	// no goroutines by the sequential engine
+	n := runtime.NumGoroutine()
+	q := sm.Query(context.Background(), ctFunc("nat")(X))
+	for i := 0; i < 100; i++ {
+		if _, ok := q.Next(); !ok {
+			t.Fatalf("Expected a solution")
+		}
+	}
+	if runtime.NumGoroutine() > n {
+		t.Errorf("Goroutines created: %d -> %d", n, runtime.NumGoroutine())
+	}
+	q.Close()
+}
+
+func BenchmarkEngines(b *testing.B) {
+	for _, engine := range []struct {
+		name   string
+		engine int
+	}{
+		{"Goroutine", GoroutineEngine},
+		{"Sequential", SequentialEngine},
+	} {
+		m := NewMachine(WithEngine(engine.engine))
+		if err := m.Consult(strings.NewReader(testProgram)); err != nil {
+			b.Fatalf("Consult failed: %v", err)
+		}
+
+		for _, query := range []string{
+			"grid(6, 6, X)",
+			"fibonacci(12, X)",
+			"descendant(X, Y)",
+			"reverse([1, 2, 3, 4, 5, 6, 7, 8, 9, 10], [], X)",
+		} {
+			goal, err := ParseGoal(query)
+			if err != nil {
+				b.Fatalf("ParseGoal(%q) failed: %v", query, err)
+			}
+
+			b.Run(engine.name+"/"+query, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					for _ = range m.Solutions(goal) {
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	const program = `
+		f(a, 1).
+		f(b, 2).
+		f(X, 3).
+		f(g(1), 4).
+		f([], 5).
+		f([x], 6).
+		f(1, 7).
+		f(g(1, 2), 8).
+		f(a + b, 9).
+		color(red, 1).
+		color(green, 2).
+		color(blue, 3).
+	`
+	gm := NewMachine()
+	sm := NewMachine(WithEngine(SequentialEngine))
+	for _, m := range []*Machine{gm, sm} {
+		if err := m.Consult(strings.NewReader(program)); err != nil {
+			t.Fatalf("Consult failed: %v", err)
+		}
+	}
+
+	for _, c := range []struct {
+		query string
+		// number of clauses tried, and of solutions
+		n, slns int
+	}{
+		{"f(a, N)", 2, 2},
+		{"f(c, N)", 1, 1},
+		{"f(g(2), N)", 2, 1},
+		{"f(g(Y), N)", 2, 2},
+		{"f([], N)", 2, 2},
+		{"f([y, z], N)", 2, 1},
+		{"f([Y|Z], N)", 2, 2},
+		{"f(1, N)", 2, 2},
+		{"f(2, N)", 1, 1},
+		{"f(Y, N)", 9, 9},
+		{"f(a + Y, N)", 2, 2},
+		{"color(blue, N)", 1, 1},
+	} {
+		goal, err := ParseGoal(c.query)
+		if err != nil {
+			t.Fatalf("ParseGoal(%q) failed: %v", c.query, err)
+		}
+		ct := goal.(*ComplexTerm)
+		rules, _ := gm.clauses(ct, newBindings())
+		if len(rules) != c.n {
+			t.Errorf("%s: expected %d clauses, got %v", c.query, c.n, rules)
+		}
+
+		exp, act := answers(t, gm, c.query), answers(t, sm, c.query)
+		assertCount(t, c.slns, len(exp))
+		if fmt.Sprint(exp) != fmt.Sprint(act) {
+			t.Errorf("%s: goroutine engine: %v, sequential engine: %v",
+				c.query, exp, act)
+		}
+	}
+
+	// no choice points left for a call with only one clause matched
+	e := sm.newSeqEngine(context.Background(), ctFunc("color")("green", pV(0)),
+		newTrailBindings(1))
+	if sln, ok := e.next(); !ok || fmt.Sprint(pV(0).unify(sln)) != "2" {
+		t.Fatalf("Expected color(green, 2)")
+	}
+	if len(e.cps) != 0 {
+		t.Errorf("Expected no choice points, got %d", len(e.cps))
+	}
+}
+
+func TestJITIndex(t *testing.T) {
+	m := NewMachine(WithEngine(SequentialEngine))
+	parent := ctFunc("parent")
+	for i := 0; i < 100; i++ {
+		m.AddFact(parent(fmt.Sprintf("p%d", i), fmt.Sprintf("p%d", i+1)))
+	}
+	if act := fmt.Sprint(m.Indexes("parent", 2)); act != "[1]" {
+		t.Errorf("Expected indexes [1], got %s", act)
+	}
+
+	ct := parent(X, "p51")
+	calcAtoms := func() (vl []string) {
+		for sln := range m.Solutions(ct) {
+			vl = append(vl, fmt.Sprint(sln.Get(V(X))))
+		}
+		return vl
+	}
+	if act := fmt.Sprint(calcAtoms()); act != "[p50]" {
+		t.Errorf("Expected [p50], got %s", act)
+	}
+	if act := fmt.Sprint(m.Indexes("parent", 2)); act != "[1 2]" {
+		t.Errorf("Expected indexes [1 2], got %s", act)
+	}
+	lq := ct.replaceVars(newPVarBindings(0)).(*ComplexTerm)
+	rules, _ := m.clauses(lq, newTrailBindings(1))
+	assertCount(t, 1, len(rules))
+
+	// kept updated when clauses are added
+	m.AddFact(parent("q", "p51"))
+	m.AddRule(R(parent(X, Y), Eq(X, "r"), Eq(Y, "p51")))
+	if act := fmt.Sprint(calcAtoms()); act != "[p50 q r]" {
+		t.Errorf("Expected [p50 q r], got %s", act)
+	}
+	rules, _ = m.clauses(lq, newTrailBindings(1))
+	assertCount(t, 3, len(rules))
+
+	// not built for small predicates
+	m.AddFact(ctFunc("small")("a", "b"))
+	m.AddFact(ctFunc("small")("b", "c"))
+	assertCount(t, 1, match(m, ctFunc("small")(X, "c")))
+	if act := fmt.Sprint(m.Indexes("small", 2)); act != "[1]" {
+		t.Errorf("Expected indexes [1], got %s", act)
+	}
+}
+
+func TestDatabase(t *testing.T) {
+	const program = `
+		counter(0).
+		incr :- retract(counter(N)), N1 is N + 1, assertz(counter(N1)).
+		p(1).
+		p(2).
+		q(1).
+		q(2).
+		q(3).
+		r(X) :- X > 1, !.
+	`
+	for _, engine := range []int{GoroutineEngine, SequentialEngine} {
+		m := NewMachine(WithEngine(engine))
+		if err := m.Consult(strings.NewReader(program)); err != nil {
+			t.Fatalf("Consult failed: %v", err)
+		}
+
+		for _, c := range []struct {
+			query, exp string
+		}{
+			{"incr, incr, counter(X)", "[X=2]"},
+			// logical update view: running calls are not affected
+			{"p(X), assertz(p(3))", "[X=1 X=2]"},
+			{"p(X)", "[X=1 X=2 X=3 X=3]"},
+			{"asserta(p(0)), p(X)", "[X=0 X=1 X=2 X=3 X=3]"},
+			{"retract(q(X)), X >= 2, !", "[X=2]"},
+			{"q(X)", "[X=3]"},
+			{"retract(q(X))", "[X=3]"},
+			{"retract((r(Y) :- B))", "[Y=_,B=,(_ > 1, !)]"},
+			{"r(5)", "[]"},
+			{"retractall(p(3)), p(X)", "[X=0 X=1 X=2]"},
+			{"abolish(p/1), assertz(p(a)), p(X)", "[X=a]"},
+		} {
+			if act := fmt.Sprint(answers(t, m, c.query)); act != c.exp {
+				t.Errorf("engine %d: %s: expected %s, got %s", engine, c.query,
+					c.exp, act)
+			}
+		}
+
+		// Go API
+		s := ctFunc("s")
+		m.AddFact(s(1))
+		rule := R(s(X), Op(X, ">", 1))
+		m.AddRule(rule)
+		m.AddFact(s(2))
+		assertCount(t, 2, match(m, s(2)))
+		if !m.RemoveRule(rule) || m.RemoveRule(rule) {
+			t.Errorf("Expected rule removed once")
+		}
+		if !m.Retract(s(X)) {
+			t.Errorf("Expected s(1) retracted")
+		}
+		assertCount(t, 1, match(m, s(Y)))
+		if m.Retract(s(3)) {
+			t.Errorf("Expected s(3) not retracted")
+		}
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	const program = `
+		edge(1, 2).
+		edge(2, 3).
+		edge(3, 4).
+		path(X, Y) :- edge(X, Y).
+		path(X, Y) :- edge(X, Z), path(Z, Y).
+	`
+	edge := ctFunc("edge")
+	for _, engine := range []int{GoroutineEngine, SequentialEngine} {
+		m := NewMachine(WithEngine(engine))
+		if err := m.Consult(strings.NewReader(program)); err != nil {
+			t.Fatalf("Consult failed: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				// a bound second argument builds an index just in time
+				goal := Goal(ctFunc("path")(1, X))
+				if i%2 == 1 {
+					goal = edge(X, 3)
+				}
+				for j := 0; j < 20; j++ {
+					n := 0
+					for range m.Solutions(goal) {
+						n++
+					}
+					if n < 1+2*(1-i%2) {
+						t.Errorf("%v: only %d solutions", goal, n)
+					}
+				}
+			}(i)
+		}
+
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					rule := R(edge(4, 1000+100*i+j))
+					m.AddRule(rule)
+					m.AddFact(edge(1000+100*i+j, 5))
+
+					goal, err := ParseGoal(fmt.Sprintf(
+						"assertz(edge(3, %d)), retract(edge(3, %d))", -j, -j))
+					if err != nil {
+						t.Errorf("ParseGoal failed: %v", err)
+						return
+					}
+					for range m.Solutions(goal) {
+					}
+
+					if !m.RemoveRule(rule) {
+						t.Errorf("Expected %v removed", rule)
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		// only the added edge(N, 5) facts are left
+		assertCount(t, 3, len(answers(t, m, "path(1, X)")))
+		assertCount(t, 1, len(answers(t, m, "edge(X, 3)")))
+		assertCount(t, 200, len(answers(t, m, "edge(X, 5)")))
+	}
+}
+
+func TestAtomGC(t *testing.T) {
+	heap := func() uint64 {
+		var ms runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		return ms.HeapAlloc
+	}
+
+	m := NewMachine()
+	f := ctFunc("f")
+	padding := strings.Repeat("x", 4096)
+	m.AddFact(f("kept" + padding))
+
+	before := heap()
+	for i := 0; i < 1000; i++ {
+		// atoms concatenated by FirstLeft
+		for sln := range m.Solutions(Eq(X, FL("a", fmt.Sprint(i, padding)))) {
+			if len(sln.Get(V(X)).(atom).String()) != len(fmt.Sprint("a", i, padding)) {
+				t.Fatalf("Unexpected solution: %v", sln)
+			}
+		}
+	}
+
+	// unreferenced atoms are released, maybe after more collections
+	var grown uint64
+	for i := 0; i < 10; i++ {
+		if grown = heap() - min(before, heap()); grown < 1<<20 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if grown >= 1<<20 {
+		t.Errorf("Heap grown by %d bytes", grown)
+	}
+
+	// atoms in clauses are kept
+	assertCount(t, 1, match(m, f("kept"+padding)))
+
+	// the atom table of a machine counts the atoms of its clauses
+	m = NewMachine()
+	if err := m.Consult(strings.NewReader("p(a, b). p(b, c). q :- p(a, _).")); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+	for _, c := range []struct {
+		query string
+		atoms int
+	}{
+		{"true", 5}, // p, a, b, c and q
+		{"X = d", 5},
+		{"retract(p(b, c))", 4},
+		{"abolish(q/0)", 3},
+		{"assertz(p(d, e))", 5},
+		{"retractall(p(_, _))", 0},
+	} {
+		answers(t, m, c.query)
+		if len(m.atoms) != c.atoms {
+			t.Errorf("%s: expected %d atoms, got %d", c.query, c.atoms, len(m.atoms))
+		}
+	}
+
+	// an atom is counted once for each clause
+	rule := R(f("a", "a", f("a")))
+	m.AddRule(rule)
+	if len(rule.atoms) != 2 || m.atoms[A("a")].refs != 1 {
+		t.Errorf("Expected f and a counted once, got %v", rule.atoms)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	const program = `
+		div(X, Y, Z) :- Z is X / Y.
+		p(1).
+		p(0).
+		q(Z) :- p(Y), div(6, Y, Z).
+	`
+	for _, engine := range []int{GoroutineEngine, SequentialEngine} {
+		m := NewMachine(WithEngine(engine))
+		if err := m.Consult(strings.NewReader(program)); err != nil {
+			t.Fatalf("Consult failed: %v", err)
+		}
+
+		for _, c := range []struct {
+			query     string
+			slns      int
+			expFormal string
+		}{
+			{"X is 1 / 0", 0, "evaluation_error(zero_divisor)"},
+			// raised in the goroutines of the clauses, after a solution
+			{"q(Z)", 1, "evaluation_error(zero_divisor)"},
+			{"p(X), 1 + X", 0, "existence_error(procedure, + / 2)"},
+			{"q(Z), !", 1, ""},
+			{"assertz(X)", 0, "instantiation_error"},
+			{"assertz(3)", 0, "type_error(callable, 3)"},
+			{"asserta((foo :- 3))", 0, "type_error(callable, 3)"},
+			{"retract((X :- true))", 0, "instantiation_error"},
+			{"retractall(3)", 0, "type_error(callable, 3)"},
+			{"abolish(foo/a)", 0, "type_error(integer, a)"},
+			{"abolish(_)", 0, "instantiation_error"},
+			{"abolish(foo/(-1))", 0, "domain_error(not_less_than_zero, -1)"},
+			{"abolish(foo)", 0, "type_error(predicate_indicator, foo)"},
+		} {
+			goal, err := ParseGoal(c.query)
+			if err != nil {
+				t.Fatalf("ParseGoal(%q) failed: %v", c.query, err)
+			}
+			q := m.Query(context.Background(), goal)
+			slns := 0
+			for _, ok := q.Next(); ok; _, ok = q.Next() {
+				slns++
+			}
+			assertCount(t, c.slns, slns)
+
+			err = q.Err()
+			if c.expFormal == "" {
+				if err != nil {
+					t.Errorf("engine %d: %s: unexpected error %v", engine, c.query, err)
+				}
+				continue
+			}
+			pe, ok := err.(*PrologError)
+			if !ok {
+				t.Errorf("engine %d: %s: expected a *PrologError, got %v", engine,
+					c.query, err)
+				continue
+			}
+			if act := fmt.Sprint(pe.Formal()); act != c.expFormal {
+				t.Errorf("engine %d: %s: expected %s, got %s", engine, c.query,
+					c.expFormal, act)
+			}
+		}
+
+		if err := m.Consult(strings.NewReader(":- X is 2 / 0.")); err == nil {
+			t.Errorf("engine %d: expected an error from the directive", engine)
+		}
+	}
+
+	// an unknown operator makes a compound term
+	if ct, ok := Op(1, "foo", 2).(*ComplexTerm); !ok || ct.Functor != A("foo") {
+		t.Errorf("Expected foo(1, 2), got %v", Op(1, "foo", 2))
+	}
+
+	// a Go value which cannot be converted is returned as an error
+	if _, err := NewTerm(make(chan int)); err == nil ||
+		fmt.Sprint(err.(*PrologError).Formal()) != "type_error(term, chan int)" {
+		t.Errorf("Expected type_error(term, chan int), got %v", err)
+	}
+	m := NewMachine()
+	bad := CT(A("f"), 1, make(chan int))
+	if err := m.AddFact(bad); err == nil {
+		t.Errorf("Expected an error from AddFact")
+	}
+	if len(m.atoms) != 0 {
+		t.Errorf("Expected no atoms kept, got %d", len(m.atoms))
+	}
+	if m.Retract(bad) {
+		t.Errorf("Expected nothing retracted")
+	}
+	q := m.Query(context.Background(), bad)
+	if _, ok := q.Next(); ok {
+		t.Errorf("Expected no solution")
+	}
+	if _, ok := q.Err().(*PrologError); !ok {
+		t.Errorf("Expected a *PrologError, got %v", q.Err())
+	}
+	if err := m.AddFact(CT(A("f"), 1, 2)); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestCatch(t *testing.T) {
+	const program = `
+		p(1).
+		p(2).
+		p(X) :- X = 3, throw(stop(X)).
+		deep(0) :- throw(bottom).
+		deep(N) :- N > 0, N1 is N - 1, deep(N1).
+	`
+	for _, engine := range []int{GoroutineEngine, SequentialEngine} {
+		m := NewMachine(WithEngine(engine))
+		if err := m.Consult(strings.NewReader(program)); err != nil {
+			t.Fatalf("Consult failed: %v", err)
+		}
+
+		for _, c := range []struct {
+			query, exp string
+		}{
+			{"catch(throw(foo), foo, X = caught)", "[X=caught]"},
+			{"catch(X is 1 / 0, error(E, _), true)",
+				"[X=_,E=evaluation_error(zero_divisor)]"},
+			{"catch(throw(_), error(E, _), true)", "[E=instantiation_error]"},
+			// active when backtracking into the goal
+			{"catch(p(X), stop(Y), true)", "[X=1,Y=_ X=2,Y=_ X=_,Y=3]"},
+			{"catch(catch(throw(a), b, X = inner), a, X = outer)", "[X=outer]"},
+			{"catch(deep(50), B, true)", "[B=bottom]"},
+			// bindings are undone, the ball is a copy
+			{"catch((X = 1, throw(f(X, Y))), f(A, B), true)", "[X=_,Y=_,A=1,B=_]"},
+			// cuts are local
+			{"catch((p(X), !), _, true)", "[X=1]"},
+			{"p(X), catch(!, _, true)", "[X=1 X=2]"},
+		} {
+			if act := fmt.Sprint(answers(t, m, c.query)); act != c.exp {
+				t.Errorf("engine %d: %s: expected %s, got %s", engine, c.query,
+					c.exp, act)
+			}
+		}
+
+		// uncaught balls, including the ones thrown after the goal of catch
+		for _, query := range []string{
+			"p(X), throw(X)",
+			"catch(p(X), _, true), throw(X)",
+		} {
+			goal, err := ParseGoal(query)
+			if err != nil {
+				t.Fatalf("ParseGoal(%q) failed: %v", query, err)
+			}
+			q := m.Query(context.Background(), goal)
+			slns := 0
+			for _, ok := q.Next(); ok; _, ok = q.Next() {
+				slns++
+			}
+			assertCount(t, 0, slns)
+			if pe, ok := q.Err().(*PrologError); !ok || pe.Term != Integer(1) {
+				t.Errorf("engine %d: %s: expected ball 1, got %v", engine, query,
+					q.Err())
+			}
+		}
+
+		// Go API
+		X := V("X")
+		q := m.Query(context.Background(), Catch(Throw(A("x")), X, Eq(V("R"), X)))
+		if sln, ok := q.Next(); !ok || sln.Get(V("R")) != A("x") {
+			t.Errorf("engine %d: expected R = x, got %v", engine, sln)
+		}
+		q.Close()
+	}
+}
+
+func TestUnknown(t *testing.T) {
+	const program = `
+		:- dynamic d/1.
+		:- dynamic (e/1, f/2), [g/0].
+		p :- qq.
+		r(1).
+	`
+	for _, engine := range []int{GoroutineEngine, SequentialEngine} {
+		m := NewMachine(WithEngine(engine))
+		if err := m.Consult(strings.NewReader(program)); err != nil {
+			t.Fatalf("Consult failed: %v", err)
+		}
+
+		for _, c := range []struct {
+			query, exp string
+		}{
+			{"catch(foo(X), error(E, _), true)",
+				"[X=_,E=existence_error(procedure, foo / 1)]"},
+			{"catch(p, error(existence_error(procedure, PI), _), true)",
+				"[PI=qq / 0]"},
+			{"d(X)", "[]"},
+			{"e(X), f(X, Y)", "[]"},
+			{"g", "[]"},
+			// still defined without clauses
+			{"retract(r(1)), r(X)", "[]"},
+			// retractall/1 makes an unknown procedure dynamic
+			{"retractall(zzz(_)), zzz(1)", "[]"},
+			{"abolish(r/1), catch(r(X), error(E, _), true)",
+				"[X=_,E=existence_error(procedure, r / 1)]"},
+			{"current_prolog_flag(unknown, V)", "[V=error]"},
+			{"catch(set_prolog_flag(unknown, bad), error(E, _), true)",
+				"[E=domain_error(flag_value, unknown + bad)]"},
+			{"set_prolog_flag(unknown, fail), foo(X)", "[]"},
+			{"current_prolog_flag(unknown, V)", "[V=fail]"},
+		} {
+			if act := fmt.Sprint(answers(t, m, c.query)); act != c.exp {
+				t.Errorf("engine %d: %s: expected %s, got %s", engine, c.query,
+					c.exp, act)
+			}
+		}
+
+		// Go API
+		m = NewMachine(WithEngine(engine), WithUnknown(UnknownFail))
+		assertCount(t, 0, match(m, ctFunc("foo")(1)))
+		m = NewMachine(WithEngine(engine))
+		m.Dynamic("foo", 1)
+		q := m.Query(context.Background(), ctFunc("foo")(1))
+		if _, ok := q.Next(); ok || q.Err() != nil {
+			t.Errorf("engine %d: expected foo(1) to fail quietly, got %v", engine,
+				q.Err())
+		}
+	}
+
+	// an invalid value is taken as the default one
+	m := NewMachine(WithUnknown(7))
+	if act := fmt.Sprint(answers(t, m, "current_prolog_flag(unknown, V)")); act != "[V=error]" {
+		t.Errorf("Expected [V=error], got %s", act)
+	}
+}
+
+func TestArith(t *testing.T) {
+	for _, engine := range []int{GoroutineEngine, SequentialEngine} {
+		m := NewMachine(WithEngine(engine))
+		for _, c := range []struct {
+			query, exp string
+		}{
+			{"X is 7 // 2 + 7 mod -2 * 10", "[X=-7]"},
+			{"X is -7 // 2", "[X=-3]"},
+			{"X is -7 div 2", "[X=-4]"},
+			{"X is -7 mod 2", "[X=1]"},
+			{"X is -7 rem 2", "[X=-1]"},
+			{"X is abs(-3) + sign(-3) + sign(0)", "[X=2]"},
+			{"X is min(2, 3) - max(2, 3)", "[X=-1]"},
+			{"X is -(2 ** 10)", "[X=-1024]"},
+			{"X is 3 ^ 3 + (-1) ^ (-3)", "[X=26]"},
+			{"X is 1 << 10 + (-16 >> 2)", "[X=1020]"},
+			{"X is 5 /\\ 3 + (5 \\/ 3) * (5 xor 3)", "[X=43]"},
+			{"X is \\ 5", "[X=-6]"},
+			{"X is msb(1000) + gcd(-12, 18)", "[X=15]"},
+			{"Y = 3, X is Y * (Y + 1)", "[Y=3,X=12]"},
+			{"catch(X is Y + 1, error(E, _), true)", "[X=_,Y=_,E=instantiation_error]"},
+			{"catch(X is foo + 1, error(E, _), true)",
+				"[X=_,E=type_error(evaluable, foo / 0)]"},
+			{"catch(X is bar(1, 2, 3), error(E, _), true)",
+				"[X=_,E=type_error(evaluable, bar / 3)]"},
+			{"catch(X is 1 mod 0, error(E, _), true)",
+				"[X=_,E=evaluation_error(zero_divisor)]"},
+			{"catch(X is 2 ^ (-1), error(E, _), true)",
+				"[X=_,E=type_error(float, 2)]"},
+		} {
+			if act := fmt.Sprint(answers(t, m, c.query)); act != c.exp {
+				t.Errorf("engine %d: %s: expected %s, got %s", engine, c.query,
+					c.exp, act)
+			}
+		}
+	}
+}
+
+func TestFloat(t *testing.T) {
+	for _, c := range []struct {
+		f   Float
+		exp string
+	}{
+		{1, "1.0"},
+		{-0.5, "-0.5"},
+		{1e10, "1.0e10"},
+		{1.5e-7, "1.5e-7"},
+		{123456.789, "123456.789"},
+	} {
+		if act := fmt.Sprint(c.f); act != c.exp {
+			t.Errorf("Expected %s, got %s", c.exp, act)
+		}
+	}
+
+	const program = `
+		w(1.5, a).
+		w(1, b).
+		w(-2.0, c).
+		avg(L, A) :- sum(L, S, N), A is S / N.
+		sum([], 0, 0).
+		sum([X|Xs], S, N) :- sum(Xs, S0, N0), S is S0 + X, N is N0 + 1.
+	`
+	for _, engine := range []int{GoroutineEngine, SequentialEngine} {
+		m := NewMachine(WithEngine(engine))
+		if err := m.Consult(strings.NewReader(program)); err != nil {
+			t.Fatalf("Consult failed: %v", err)
+		}
+
+		for _, c := range []struct {
+			query, exp string
+		}{
+			{"X = 1.25e2", "[X=125.0]"},
+			{"w(1.5, X)", "[X=a]"},
+			{"w(1, X)", "[X=b]"},
+			{"w(1.0, X)", "[]"},
+			{"w(-2.0, X)", "[X=c]"},
+			{"avg([1, 2, 3, 4], A)", "[A=2.5]"},
+			{"avg([1, 2, 3], A)", "[A=2]"},
+			{"X is 1 + 0.5 * 3", "[X=2.5]"},
+			{"X is 2 ** -1 + 2 ** 3", "[X=8.5]"},
+			{"X is sqrt(16) + abs(-1.5) + sign(-2.5)", "[X=4.5]"},
+			{"X is exp(log(2.0)) * sin(0) + cos(0)", "[X=1.0]"},
+			{"X is floor(-1.5) + ceiling(1.2) + round(2.5) + truncate(-3.7)",
+				"[X=0]"},
+			{"X is integer(2.5) + float(1)", "[X=4.0]"},
+			{"X is max(1, 1.5) + min(2, 2.0)", "[X=3.5]"},
+			{"X is float_integer_part(-2.5) + float_fractional_part(-2.5)",
+				"[X=-2.5]"},
+			{"X is pi / 4, Y is tan(X)", "[X=0.7853981633974483,Y=1.0]"},
+			{"X = y, 1.5 > 1", "[X=y]"},
+			{"X = y, 2 =< 2.0", "[X=y]"},
+			{"X = y, 2 =\\= 2.0", "[]"},
+			{"catch(X is 1 / 0.0, error(E, _), true)",
+				"[X=_,E=evaluation_error(zero_divisor)]"},
+			{"catch(X is sqrt(-1), error(E, _), true)",
+				"[X=_,E=evaluation_error(undefined)]"},
+			{"catch(X is 10.0 ** 400, error(E, _), true)",
+				"[X=_,E=evaluation_error(float_overflow)]"},
+			{"catch(X is 5.0 mod 2, error(E, _), true)",
+				"[X=_,E=type_error(integer, 5.0)]"},
+		} {
+			if act := fmt.Sprint(answers(t, m, c.query)); act != c.exp {
+				t.Errorf("engine %d: %s: expected %s, got %s", engine, c.query,
+					c.exp, act)
+			}
+		}
+
+		// Go API
+		assertCount(t, 1, match(m, ctFunc("w")(1.5, A("a"))))
+	}
+}
+
+func TestBigInt(t *testing.T) {
+	const program = `
+		factorial(0, 1) :- !.
+		factorial(N, F) :- N1 is N - 1, factorial(N1, F1), F is N * F1.
+		big(123456789012345678901234567890, a).
+		big(9223372036854775807, b).
+	`
+	for _, engine := range []int{GoroutineEngine, SequentialEngine} {
+		m := NewMachine(WithEngine(engine))
+		if err := m.Consult(strings.NewReader(program)); err != nil {
+			t.Fatalf("Consult failed: %v", err)
+		}
+
+		for _, c := range []struct {
+			query, exp string
+		}{
+			{"factorial(25, X)", "[X=15511210043330985984000000]"},
+			{"X is 9223372036854775807 + 1", "[X=9223372036854775808]"},
+			{"X is -9223372036854775807 - 2", "[X=-9223372036854775809]"},
+			{"X is -(-9223372036854775807 - 1)", "[X=9223372036854775808]"},
+			{"X is 2 ** 100 - 2 ** 100 + 1", "[X=1]"},
+			{"X is (2 ** 64 + 1) mod 10 + 2 ** 64 // 2 ** 62", "[X=11]"},
+			{"X is 1 << 70 >> 68", "[X=4]"},
+			{"X is -(2 ** 70) div 3", "[X=-393530540239137101142]"},
+			{"X is msb(2 ** 80) + gcd(2 ** 70, 6 ** 3)", "[X=88]"},
+			{"X is 2 ** 70 / 2 ** 69", "[X=2]"},
+			{"X is 2 ** 64 + 0.5", "[X=1.8446744073709552e19]"},
+			{"X is truncate(1.0e20)", "[X=100000000000000000000]"},
+			{"X = 0x10000000000000000", "[X=18446744073709551616]"},
+			{"big(123456789012345678901234567890, X)", "[X=a]"},
+			{"X is 2 ** 63 - 1, big(X, Y)", "[X=9223372036854775807,Y=b]"},
+			{"X is 2 ** 64, X > 9223372036854775807, X < 1.0e30, X =< X",
+				"[X=18446744073709551616]"},
+			{"X is 2 ** 64, X > 1.0e30", "[]"},
+			{"catch(X is 1 << (2 ** 70), error(E, _), true)",
+				"[X=_,E=evaluation_error(int_overflow)]"},
+			{"catch(X is (2 ** 70) mod 0, error(E, _), true)",
+				"[X=_,E=evaluation_error(zero_divisor)]"},
+		} {
+			if act := fmt.Sprint(answers(t, m, c.query)); act != c.exp {
+				t.Errorf("engine %d: %s: expected %s, got %s", engine, c.query,
+					c.exp, act)
+			}
+		}
+
+		// Go API
+		i, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+		assertCount(t, 1, match(m, ctFunc("big")(i, A("a"))))
+	}
+}
+
+func TestRational(t *testing.T) {
+	const program = `
+		price(1r3, a).
+		price(2, b).
+		total([], 0).
+		total([X|Xs], T) :- total(Xs, T0), T is T0 + X.
+	`
+	for _, engine := range []int{GoroutineEngine, SequentialEngine} {
+		m := NewMachine(WithEngine(engine))
+		if err := m.Consult(strings.NewReader(program)); err != nil {
+			t.Fatalf("Consult failed: %v", err)
+		}
+
+		for _, c := range []struct {
+			query, exp string
+		}{
+			{"X = 2r6", "[X=1r3]"},
+			{"X = -1r3", "[X=-1r3]"},
+			{"X = 4r2", "[X=2]"},
+			{"X is 1 rdiv 3 + 1 rdiv 6", "[X=1r2]"},
+			{"X is 1r3 * 3", "[X=1]"},
+			{"X is 1r3 - 1r2", "[X=-1r6]"},
+			{"X is 1r3 / 2", "[X=1r6]"},
+			{"X is 1r3 + 0.5", "[X=0.8333333333333333]"},
+			{"X is (2r3) ** 2 + (2r3) ^ (-1)", "[X=35r18]"},
+			{"X is -(1r3) + abs(-1r3) + sign(-1r3)", "[X=-1]"},
+			{"X is max(1r3, 0.3) + min(1r3, 1r2)", "[X=2r3]"},
+			{"total([1r3, 1r3, 1r3], X)", "[X=1]"},
+			{"total([1r10, 1r5], X)", "[X=3r10]"},
+			{"X is numerator(6r4) + denominator(6r4) + numerator(7)", "[X=12]"},
+			{"X is rational(0.25) + rationalize(0.1)", "[X=7r20]"},
+			{"X is rational(0.1)", "[X=3602879701896397r36028797018963968]"},
+			{"X is floor(-7r2) + ceiling(7r2) + truncate(-7r2) + round(-5r2)",
+				"[X=-6]"},
+			{"X is float(1r4)", "[X=0.25]"},
+			{"price(1r3, X)", "[X=a]"},
+			{"X is 2 rdiv 6, price(X, Y)", "[X=1r3,Y=a]"},
+			{"X is 4 rdiv 2, price(X, Y)", "[X=2,Y=b]"},
+			{"X = y, 1r3 < 1r2", "[X=y]"},
+			{"X = y, 1r3 > 0.34", "[]"},
+			{"catch(X is 1r3 mod 2, error(E, _), true)",
+				"[X=_,E=type_error(integer, 1r3)]"},
+			{"catch(X is 1 rdiv 0.5, error(E, _), true)",
+				"[X=_,E=type_error(rational, 0.5)]"},
+			{"catch(X is 1r3 / 0, error(E, _), true)",
+				"[X=_,E=evaluation_error(zero_divisor)]"},
+		} {
+			if act := fmt.Sprint(answers(t, m, c.query)); act != c.exp {
+				t.Errorf("engine %d: %s: expected %s, got %s", engine, c.query,
+					c.exp, act)
+			}
+		}
+
+		// Go API
+		assertCount(t, 1, match(m, ctFunc("price")(big.NewRat(2, 6), A("a"))))
+	}
+}
+
+func TestArithCompare(t *testing.T) {
+	for _, engine := range []int{GoroutineEngine, SequentialEngine} {
+		m := NewMachine(WithEngine(engine))
+		for _, c := range []struct {
+			query, exp string
+		}{
+			{"X = 1, Y = 2, X + 1 > Y", "[]"},
+			{"X = 1, Y = 2, X + 1 >= Y", "[X=1,Y=2]"},
+			{"X = 1, Y = 2, X + 1 =:= Y", "[X=1,Y=2]"},
+			{"X = 1, Y = 2, X + 1 =\\= Y", "[]"},
+			{"X = y, 1 + 1 =:= 2.0, 1 =\\= 1.5, 0.5 =:= 1r2", "[X=y]"},
+			{"X = y, 2 * 3 < 7, 7 =< 14 / 2, 2 ** 64 > 2 ** 63", "[X=y]"},
+			{"X = y, 1r3 < 0.34, 2 ** 64 >= 1.0e19, 1 rdiv 3 =:= 2r6", "[X=y]"},
+			{"X = y, 2 ** 64 < 1.0e19", "[]"},
+			{"(X = 3 ; X = 1.5 ; X = 1r2 ; X = 2 ** 70), X > 1",
+				"[X=3 X=1.5 X=**(2, 70)]"},
+			{"catch(X < 1, error(E, _), true)", "[X=_,E=instantiation_error]"},
+			{"catch(1 =:= 1 + Y, error(E, _), true)",
+				"[Y=_,E=instantiation_error]"},
+			{"catch((X = a, X > 1), error(E, _), true)",
+				"[X=_,E=type_error(evaluable, a / 0)]"},
+		} {
+			if act := fmt.Sprint(answers(t, m, c.query)); act != c.exp {
+				t.Errorf("engine %d: %s: expected %s, got %s", engine, c.query,
+					c.exp, act)
+			}
+		}
+
+		// Go API
+		count := 0
+		for range m.Prove(Op(Op(1, "+", 1), "=:=", 2)) {
+			count++
+		}
+		assertCount(t, 1, count)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	for _, c := range []struct {
+		a, b interface{}
+		exp  int
+	}{
+		{V("X"), 1, -1},
+		{1, 1.0, 1},
+		{1.5, 1, 1},
+		{Big(new(big.Int).Lsh(big.NewInt(1), 70)), 1.0e30, -1},
+		{Rat(big.NewRat(1, 3)), 0.5, -1},
+		{100, A("a"), -1},
+		{A("abc"), A("abd"), -1},
+		{L(), A("a"), -1},
+		{FL("a", "bc"), A("abc"), 0},
+		{FL("a", V("X")), A("a"), -1},
+		{A("z"), CT(A("a"), 1), -1},
+		{CT(A("b"), 1), CT(A("a"), 1, 2), -1},
+		{CT(A("b"), 1, 2), CT(A("a"), 1, 2), 1},
+		{CT(A("a"), 1, 2), CT(A("a"), 1, 3), -1},
+		{L(1, 2), CT(A("f"), 1, 2), -1},
+		{L(1, 2), HT(1, L(2)), 0},
+		{HT(1, V("T")), L(1, 2), -1},
+		// representations which do not unify are not identical
+		{Op(1, "+", 2), CT(A("+"), 1, 2), 1},
+		{Op(1, "=<", 2), CT(A("=<"), 1, 2), 1},
+		{Op(1, "=\\=", 2), CT(A("=\\="), 1, 2), 1},
+		{L(), A("[]"), 1},
+		{L(1), CT(A("."), 1, L()), 1},
+		{Op(1, "+", 2), Op(1, "+", 3), -1},
+	} {
+		if act := Compare(term(c.a), term(c.b)); act != c.exp {
+			t.Errorf("Compare(%v, %v): expected %d, got %d", c.a, c.b, c.exp, act)
+		}
+		if act := Compare(term(c.b), term(c.a)); act != -c.exp {
+			t.Errorf("Compare(%v, %v): expected %d, got %d", c.b, c.a, -c.exp, act)
+		}
+	}
+
+	for _, engine := range []int{GoroutineEngine, SequentialEngine} {
+		m := NewMachine(WithEngine(engine))
+		for _, c := range []struct {
+			query, exp string
+		}{
+			{"X = f(Y), X == f(Y)", "[X=f(_),Y=_]"},
+			{"X == Y", "[]"},
+			{"X = y, X \\== Y", "[X=y,Y=_]"},
+			{"X = y, 1 == 1.0", "[]"},
+			{"X = y, f(a) @< f(b), g(a) @> f(b), 1.0 @=< 1, a @>= a", "[X=y]"},
+			{"X = y, [] @< [a], 2 @> 1r2, 1r2 @< 1, f(1, 2) @> 2 ** 70", "[X=y]"},
+			{"compare(O, 1, a)", "[O=<]"},
+			{"compare(O, f(X), f(X))", "[O==,X=_]"},
+			{"compare(O, g(1), f(1, 2))", "[O=<]"},
+			{"'[]' == []", "[]"},
+			{"compare(O, [], '[]')", "[O=>]"},
+			{"compare(O, (1 =< 2), '=<'(1, 2))", "[O==]"},
+			{"compare(O, (1 =\\= 2), '=\\\\='(1, 2))", "[O==]"},
+			{"compare(>, b, a)", "[]"},
+			{"X = y, compare(<, b, a)", "[]"},
+			{"catch(compare(foo, a, b), error(E, _), true)",
+				"[E=domain_error(order, foo)]"},
+			{"catch(compare(1, a, b), error(E, _), true)",
+				"[E=type_error(atom, 1)]"},
+		} {
+			if act := fmt.Sprint(answers(t, m, c.query)); act != c.exp {
+				t.Errorf("engine %d: %s: expected %s, got %s", engine, c.query,
+					c.exp, act)
+			}
+		}
+	}
+}
+
+func TestSort(t *testing.T) {
+	const program = `
+		byLen(O, A, B) :- lenOf(A, LA), lenOf(B, LB), compare(O, LA, LB).
+		lenOf([], 0).
+		lenOf([_|T], N) :- lenOf(T, N0), N is N0 + 1.
+		desc(O, A, B) :- compare(O, B, A).
+		bad(foo, _, _).
+		byMod(M, O, A, B) :- X is A mod M, Y is B mod M, compare(O, X, Y).
+		seen(X, O, A, B) :- X = yes, compare(O, A, B).
+		cutCmp(O, A, B) :- compare(O, A, B), !.
+		cutCmp(>, _, _).
+		loop(O, A, B) :- loop(O, A, B).
+	`
+	for _, engine := range []int{GoroutineEngine, SequentialEngine} {
+		m := NewMachine(WithEngine(engine))
+		if err := m.Consult(strings.NewReader(program)); err != nil {
+			t.Fatalf("Consult failed: %v", err)
+		}
+
+		for _, c := range []struct {
+			query, exp string
+		}{
+			{"sort([c, a, b, a, 2, 1.0, f(x), Z], X)", "[Z=_,X=[_ 1.0 2 a b c f(x)]]"},
+			{"msort([c, a, b, a], X)", "[X=[a a b c]]"},
+			{"sort([], X)", "[X=[]]"},
+			{"sort([b|T], X)", "[]"},
+			{"T = [a, c], sort([b|T], X)", "[T=[a c],X=[a b c]]"},
+			{"sort([b, a], [a, b])", "[]"},
+			{"X = y, sort([b, a], [a, b])", "[X=y]"},
+			{"keysort([b-1, a-2, b-0, a-1], X)", "[X=[a - 2 a - 1 b - 1 b - 0]]"},
+			{"sort(0, @>=, [1, 3, 2, 3], X)", "[X=[3 3 2 1]]"},
+			{"sort(0, @>, [1, 3, 2, 3], X)", "[X=[3 2 1]]"},
+			{"sort(1, @<, [f(2, a), f(1, b), f(2, c)], X)", "[X=[f(1, b) f(2, a)]]"},
+			{"sort(1, @=<, [f(2, a), f(1, b), f(2, c)], X)",
+				"[X=[f(1, b) f(2, a) f(2, c)]]"},
+			{"sort(2, @>=, [f(2, a), f(1, b), f(2, a)], X)",
+				"[X=[f(1, b) f(2, a) f(2, a)]]"},
+			{"predsort(byLen, [[a, b], [c], [d, e], []], X)", "[X=[[] [c] [a b]]]"},
+			{"predsort(desc, [1, 3, 2], X)", "[X=[3 2 1]]"},
+			{"predsort(byMod(3), [5, 3, 4, 6], X)", "[X=[3 4 5]]"},
+			{"catch(sort(foo, X), error(E, _), true)",
+				"[X=_,E=type_error(list, foo)]"},
+			{"catch(msort([a|_], X), error(E, _), true)",
+				"[X=_,E=instantiation_error]"},
+			{"catch(keysort([a-1, b], X), error(E, _), true)",
+				"[X=_,E=type_error(pair, b)]"},
+			{"catch(sort(a, @<, [], X), error(E, _), true)",
+				"[X=_,E=type_error(integer, a)]"},
+			{"catch(sort(0, foo, [], X), error(E, _), true)",
+				"[X=_,E=domain_error(order, foo)]"},
+			{"catch(sort(2, @<, [f(1)], X), error(E, _), true)",
+				"[X=_,E=type_error(compound, f(1))]"},
+			{"catch(predsort(bad, [1, 2], X), error(E, _), true)",
+				"[X=_,E=domain_error(order, foo)]"},
+			{"catch(predsort(1, [1, 2], X), error(E, _), true)",
+				"[X=_,E=type_error(callable, 1)]"},
+			{"catch(predsort(byMod(0), [1, 2], X), error(E, _), true)",
+				"[X=_,E=evaluation_error(zero_divisor)]"},
+			{"predsort(fail, [1, 2], X)", "[]"},
+			// Pred is proved with the bindings of the caller
+			{"predsort(seen(Y), [b, a], X)", "[Y=yes,X=[a b]]"},
+			{"Y = no, predsort(seen(Y), [b, a], X)", "[]"},
+			{"predsort(cutCmp, [2, 1, 3], X), !", "[X=[1 2 3]]"},
+			{"predsort(compare, [c, a, b], X)", "[X=[a b c]]"},
+		} {
+			if act := fmt.Sprint(answers(t, m, c.query)); act != c.exp {
+				t.Errorf("engine %d: %s: expected %s, got %s", engine, c.query,
+					c.exp, act)
+			}
+		}
+
+		// Pred is stopped by the context of the query
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		goal, _ := ParseGoal("predsort(loop, [1, 2], X)")
+		q := m.Query(ctx, goal)
+		if _, ok := q.Next(); ok {
+			t.Errorf("engine %d: expected no solution", engine)
+		}
+		if q.Err() != context.DeadlineExceeded {
+			t.Errorf("engine %d: expected DeadlineExceeded, got %v", engine, q.Err())
+		}
+		cancel()
+	}
+}
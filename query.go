@@ -0,0 +1,204 @@
+package plg
+
+import (
+	"context"
+	"iter"
+)
+
+/*
+	Query: a running query of a Machine.
+
+	q := m.Query(ctx, goal)
+	defer q.Close()
+	for sln, ok := q.Next(); ok; sln, ok = q.Next() {
+		...
+	}
+	if err := q.Err(); err != nil {
+		...
+	}
+
+	or, using iterators:
+
+	for sln := range m.Solutions(goal) {
+		...
+	}
+*/
+
+type Query struct {
+	m    *Machine
+	goal Goal
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// named variables in goal
+	vars []variable
+	// variables of goal -> p-variables
+	inBds *pVarBindings
+	slns  solver
+
+	started, closed bool
+	err             error
+}
+
+// Query creates a query proving goal. The goal is not proved until Next is
+// called. When ctx is done, or Close is called, all the goroutines proving the
+// goal are stopped.
+func (m *Machine) Query(ctx context.Context, goal Goal) *Query {
+	ctx, cancel := context.WithCancel(ctx)
+
+	q := &Query{m: m, goal: goal, ctx: ctx, cancel: cancel}
+	if err := q.collectVars(); err != nil {
+		// an invalid term in goal stops the query before started
+		q.err = err
+		q.Close()
+	}
+	return q
+}
+
+// collectVars collects the named variables of the goal into q.vars.
+func (q *Query) collectVars() (err *PrologError) {
+	defer recoverError(&err)
+
+	vc := &varCollector{}
+	q.goal.replaceGoalVars(vc)
+	q.vars = vc.vars
+	return nil
+}
+
+// Next returns the next solution, which binds the named variables of the goal.
+// ok is false if no more solutions, or the query is closed or cancelled.
+func (q *Query) Next() (sln *Bindings, ok bool) {
+	if q.closed {
+		return nil, false
+	}
+
+	bds, ok, err := q.solve()
+	if !ok {
+		if err != nil {
+			q.err = err
+		} else {
+			// ctx is only cancelled by the caller before q is closed
+			q.err = q.ctx.Err()
+		}
+		q.Close()
+		return nil, false
+	}
+
+	sln = newBindings()
+	for _, v := range q.vars {
+		sln.Put(v, q.inBds.get(v).export(bds))
+	}
+	return sln, true
+}
+
+// Close stops the query and all its goroutines. Close should not be called
+// concurrently with Next, cancel the context instead.
+func (q *Query) Close() {
+	if q.closed {
+		return
+	}
+	q.closed = true
+
+	q.cancel()
+	if q.slns != nil {
+		q.slns.close()
+	}
+}
+
+// Err returns the error stopping the query, e.g. a *PrologError raised when
+// proving the goal, or the error of the context if it is cancelled. nil if the
+// query is not stopped by an error.
+func (q *Query) Err() error {
+	return q.err
+}
+
+// Solutions returns an iterator of the solutions of goal. Breaking the loop
+// stops proving the goal. An error raised when proving the goal is discarded,
+// i.e. the loop just ends as if there were no more solutions. Use
+// SolutionsContext or Query to see it.
+func (m *Machine) Solutions(goal Goal) iter.Seq[*Bindings] {
+	return func(yield func(sln *Bindings) bool) {
+		for sln, err := range m.SolutionsContext(context.Background(), goal) {
+			if err != nil || !yield(sln) {
+				return
+			}
+		}
+	}
+}
+
+// SolutionsContext returns an iterator of the solutions of goal, with a nil
+// error for each of them. If the query is stopped by an error, e.g. ctx is
+// cancelled, the error is yielded with a nil solution at the end.
+func (m *Machine) SolutionsContext(ctx context.Context, goal Goal) iter.Seq2[*Bindings, error] {
+	return func(yield func(sln *Bindings, err error) bool) {
+		q := m.Query(ctx, goal)
+		defer q.Close()
+
+		for sln, ok := q.Next(); ok; sln, ok = q.Next() {
+			if !yield(sln, nil) {
+				return
+			}
+		}
+
+		if err := q.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+// solver is implemented by engines, i.e. *solutionStream and *seqEngine.
+type solver interface {
+	// ok is false if no more solutions
+	next() (sln *Bindings, ok bool)
+	// stops proving
+	close()
+}
+
+// solve starts proving the goal if not started, and returns the next solution.
+// An error raised when proving is returned as err, with ok false.
+func (q *Query) solve() (sln *Bindings, ok bool, err *PrologError) {
+	defer recoverError(&err)
+
+	if !q.started {
+		q.started = true
+		// localize the goal
+		q.inBds = newPVarBindings(0)
+		goal := q.goal.replaceGoalVars(q.inBds)
+		bds := newTrailBindings(q.inBds.Count)
+		if q.m.engine == SequentialEngine {
+			q.slns = q.m.newSeqEngine(q.ctx, goal, bds)
+		} else {
+			q.slns = q.m.prove(q.ctx, goal, bds, &cutBarrier{})
+		}
+	}
+
+	sln, ok = q.slns.next()
+	return sln, ok, nil
+}
+
+/* varCollector: collects named variables as a VarBindings */
+
+type varCollector struct {
+	vars []variable
+}
+
+func (vc *varCollector) atom(at atom) atom {
+	return at
+}
+
+func (vc *varCollector) get(v variable) variable {
+	if !v.isNamed() {
+		// not a named variable
+		return v
+	}
+
+	for _, vv := range vc.vars {
+		if vv == v {
+			return v
+		}
+	}
+	vc.vars = append(vc.vars, v)
+
+	return v
+}
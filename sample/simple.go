@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"github.com/daviddengcn/go-prolog"
 	"fmt"
 //	"runtime/pprof"
@@ -59,10 +60,16 @@ func calcInt(m *plg.Machine, ct *plg.ComplexTerm, rV string) (vl []int) {
 	return vl
 }
 
+var seq = flag.Bool("seq", false, "use the sequential engine")
+
 func grid(w, h int) {
 	grid := ctFunc("grid")
 
-	m := plg.NewMachine()
+	var opts []plg.Option
+	if *seq {
+		opts = append(opts, plg.WithEngine(plg.SequentialEngine))
+	}
+	m := plg.NewMachine(opts...)
 
 	m.AddFact(grid(X, 0, 1))
 	m.AddFact(grid(0, X, 1))
@@ -92,6 +99,7 @@ func goGrid(w, h int) int {
 }
 
 func main() {
+	flag.Parse()
 	/*
 	f, err := os.Create("simple.cpu.prof")
 	if err != nil {
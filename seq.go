@@ -0,0 +1,366 @@
+package plg
+
+import (
+	"context"
+	"fmt"
+)
+
+/*
+	Sequential engine: *seqEngine
+
+	Proves goals by depth-first backtracking without any goroutine. The goals
+	to prove are kept in a continuation, and the alternatives in a stack of
+	choice points. Bindings put after a choice point is created are undone when
+	backtracking to it.
+
+	A cut cuts the choice point stack back to the height when the clause was
+	called.
+
+	A catch/3 puts a ckCatch node after its goal in the continuation, so the
+	catch is active when the node is in the continuation of the goal raising
+	an error, including after backtracking into the goal.
+*/
+
+// Constants for kinds of continuation nodes.
+const (
+	ckGoal    = iota // prove goal
+	ckClauses        // try clauses of a call, starting from a clause
+	ckAlts           // try alternatives of a builtin call, starting from one
+	ckCommit         // commit of if-then-else, cut back to a height
+	ckSoft           // commit of soft-cut, disable the choice point of else
+	ckCatch          // exit of the goal of catch/3
+)
+
+type seqCont struct {
+	kind int
+	goal Goal
+	// height of the choice point stack where cuts in goal cut back to
+	cutB int
+
+	// ckClauses, ckAlts: the call and the index of the clause, or the
+	// alternative, to try
+	call *seqCall
+	from int
+
+	// ckCommit: height to cut back to
+	// ckSoft: index of the choice point of else
+	// ckCatch: height when catch/3 was called
+	height int
+	// ckCatch: bindings when catch/3 was called
+	mark bdsMark
+
+	next *seqCont
+}
+
+// seqCall is a call of a predicate.
+type seqCall struct {
+	rules []*Rule
+	goal  *ComplexTerm
+	// alternatives of a nondeterministic builtin call
+	alts []func() bool
+}
+
+type choicePoint struct {
+	// the alternative to resume
+	cont *seqCont
+	mark bdsMark
+	// disabled by soft-cut
+	dead bool
+}
+
+type seqEngine struct {
+	m   *Machine
+	ctx context.Context
+
+	cont *seqCont
+	bds  *Bindings
+	cps  []choicePoint
+
+	started, finished bool
+	steps             int
+}
+
+func (m *Machine) newSeqEngine(ctx context.Context, goal Goal, bds *Bindings) *seqEngine {
+	e := &seqEngine{m: m, ctx: ctx, bds: bds}
+	e.cont = &seqCont{kind: ckGoal, goal: goal}
+	return e
+}
+
+// next returns the next solution. The solution is valid until next is called
+// again.
+func (e *seqEngine) next() (sln *Bindings, ok bool) {
+	if e.finished {
+		return nil, false
+	}
+
+	if e.started && !e.backtrack() {
+		e.close()
+		return nil, false
+	}
+	e.started = true
+
+	if !e.run() {
+		e.close()
+		return nil, false
+	}
+
+	return e.bds, true
+}
+
+func (e *seqEngine) close() {
+	e.finished = true
+	e.cont, e.cps = nil, nil
+}
+
+// run proves the goals in the continuation until it is empty, i.e. a solution
+// is found. Returns false if no more solutions or ctx is done.
+func (e *seqEngine) run() bool {
+	for e.cont != nil {
+		if e.steps++; e.steps%1024 == 0 && e.ctx.Err() != nil {
+			return false
+		}
+
+		c := e.cont
+		e.cont = c.next
+		ok, ball := e.safeStep(c)
+		if ball != nil {
+			ok = e.catch(c.next, ball)
+		}
+		if !ok && !e.backtrack() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// safeStep calls step(c), and returns the ball thrown by it.
+func (e *seqEngine) safeStep(c *seqCont) (ok bool, ball *PrologError) {
+	defer recoverError(&ball)
+	return e.step(c), nil
+}
+
+// catch finds the innermost active catch/3 in cont whose catcher matches ball,
+// and continues with its recovery. The ball is thrown on if no one matches.
+func (e *seqEngine) catch(cont *seqCont, ball *PrologError) bool {
+	for c := cont; c != nil; c = c.next {
+		if c.kind != ckCatch {
+			continue
+		}
+
+		cg := c.goal.(*CatchGoal)
+		e.cps = e.cps[:c.height]
+		e.bds.undo(c.mark)
+		if matchTerm(cg.Catcher, ball.Term, e.bds) {
+			// cuts in Recovery are local
+			e.cont = &seqCont{kind: ckGoal, goal: cg.Recovery, cutB: c.height,
+				next: c.next}
+			return true
+		}
+		e.bds.undo(c.mark)
+	}
+
+	panic(ball)
+}
+
+// backtrack resumes the last choice point. Returns false if no choice points.
+func (e *seqEngine) backtrack() bool {
+	for len(e.cps) > 0 {
+		cp := e.cps[len(e.cps)-1]
+		e.cps = e.cps[:len(e.cps)-1]
+		if cp.dead {
+			continue
+		}
+
+		e.bds.undo(cp.mark)
+		e.cont = cp.cont
+		return true
+	}
+
+	return false
+}
+
+// push creates a choice point resuming cont with current bindings.
+func (e *seqEngine) push(cont *seqCont) {
+	e.pushAt(cont, e.bds.mark())
+}
+
+// pushAt creates a choice point resuming cont with bindings undone to mk.
+func (e *seqEngine) pushAt(cont *seqCont, mk bdsMark) {
+	e.cps = append(e.cps, choicePoint{cont: cont, mark: mk})
+}
+
+// step proves the goal in c. e.cont has been set to c.next. Returns false for
+// failure.
+func (e *seqEngine) step(c *seqCont) bool {
+	switch c.kind {
+	case ckClauses:
+		return e.tryClauses(c.call, c.from, c.next)
+
+	case ckAlts:
+		return e.tryAlts(c.call, c.from, c.next)
+
+	case ckCommit:
+		e.cps = e.cps[:c.height]
+		return true
+
+	case ckSoft:
+		e.cps[c.height].dead = true
+		return true
+
+	case ckCatch:
+		// Goal exited, the catch is inactive until backtracking into Goal
+		return true
+	}
+
+	goal := c.goal
+	switch goal.GoalType() {
+	case gtConj:
+		cg := goal.(ConjGoal)
+		for i := len(cg) - 1; i >= 0; i-- {
+			e.cont = &seqCont{kind: ckGoal, goal: cg[i], cutB: c.cutB,
+				next: e.cont}
+		}
+		return true
+
+	case gtDisj:
+		dg := goal.(DisjGoal)
+		if len(dg) == 0 {
+			// failure
+			return false
+		}
+		if len(dg) > 1 {
+			e.push(&seqCont{kind: ckGoal, goal: dg[1:], cutB: c.cutB,
+				next: e.cont})
+		}
+		e.cont = &seqCont{kind: ckGoal, goal: dg[0], cutB: c.cutB, next: e.cont}
+		return true
+
+	case gtCut:
+		e.cps = e.cps[:c.cutB]
+		return true
+
+	case gtNot:
+		// \+ Goal is (Goal -> fail ; true)
+		ng := goal.(*NotGoal)
+		return e.step(&seqCont{kind: ckGoal,
+			goal: IfThenElse(ng.Goal, Or(), And()), cutB: c.cutB})
+
+	case gtIf:
+		ig := goal.(*IfGoal)
+		height := len(e.cps)
+		if ig.Else != nil {
+			e.push(&seqCont{kind: ckGoal, goal: ig.Else, cutB: c.cutB,
+				next: e.cont})
+		}
+
+		then := &seqCont{kind: ckGoal, goal: ig.Then, cutB: c.cutB,
+			next: e.cont}
+		switch {
+		case !ig.Soft:
+			// commit to the first solution of Cond
+			then = &seqCont{kind: ckCommit, height: height, next: then}
+		case ig.Else != nil:
+			then = &seqCont{kind: ckSoft, height: height, next: then}
+		}
+
+		// cuts in Cond are local to Cond
+		e.cont = &seqCont{kind: ckGoal, goal: ig.Cond, cutB: len(e.cps),
+			next: then}
+		return true
+
+	case gtCatch:
+		cg := goal.(*CatchGoal)
+		exit := &seqCont{kind: ckCatch, goal: cg, height: len(e.cps),
+			mark: e.bds.mark(), next: e.cont}
+		// cuts in Goal are local
+		e.cont = &seqCont{kind: ckGoal, goal: cg.Goal, cutB: len(e.cps),
+			next: exit}
+		return true
+
+	case gtThrow:
+		throwBall(goal.(*ThrowGoal).Ball, e.bds)
+		return false
+
+	case gtMatch, gtOp:
+		return evalBuiltin(goal, e.bds)
+
+	case gtComplex:
+		ct := goal.(*ComplexTerm)
+		if ct.Key() == keyCall {
+			// cuts in the goal are local to it
+			e.cont = &seqCont{kind: ckGoal, goal: callGoal(ct, e.bds),
+				cutB: len(e.cps), next: e.cont}
+			return true
+		}
+		if bi := gBuiltins[ct.Key()]; bi != nil {
+			if bi.det != nil {
+				return bi.det(e.m, ct.Args, e.bds)
+			}
+			if bi.detCtx != nil {
+				return bi.detCtx(e.ctx, e.m, ct.Args, e.bds)
+			}
+			call := &seqCall{goal: ct, alts: bi.nondet(e.m, ct.Args, e.bds)}
+			return e.tryAlts(call, 0, e.cont)
+		}
+
+		call := &seqCall{rules: e.m.callClauses(ct, e.bds), goal: ct}
+		return e.tryClauses(call, 0, e.cont)
+	}
+
+	throwError(typeError("callable", A(fmt.Sprint(goal)), nil), e.bds)
+	return false
+}
+
+// tryClauses tries the clauses of call starting from index from. next is the
+// continuation after the call.
+func (e *seqEngine) tryClauses(call *seqCall, from int, next *seqCont) bool {
+	rules := call.rules
+	mk := e.bds.mark()
+	for i := from; i < len(rules); i++ {
+		body, ok := rules[i].matchHead(call.goal, e.bds)
+		if !ok {
+			// head not matched
+			e.bds.undo(mk)
+			continue
+		}
+
+		// cuts in the body cut back to here
+		height := len(e.cps)
+		if i+1 < len(rules) {
+			e.pushAt(&seqCont{kind: ckClauses, call: call, from: i + 1,
+				next: next}, mk)
+		}
+
+		if body == nil {
+			e.cont = next
+			return true
+		}
+
+		e.cont = &seqCont{kind: ckGoal, goal: body, cutB: height, next: next}
+		return true
+	}
+
+	return false
+}
+
+// tryAlts tries the alternatives of a builtin call starting from index from.
+// next is the continuation after the call.
+func (e *seqEngine) tryAlts(call *seqCall, from int, next *seqCont) bool {
+	mk := e.bds.mark()
+	for i := from; i < len(call.alts); i++ {
+		if !call.alts[i]() {
+			e.bds.undo(mk)
+			continue
+		}
+
+		if i+1 < len(call.alts) {
+			e.pushAt(&seqCont{kind: ckAlts, call: call, from: i + 1,
+				next: next}, mk)
+		}
+		e.cont = next
+		return true
+	}
+
+	return false
+}
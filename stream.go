@@ -0,0 +1,143 @@
+package plg
+
+import (
+	"context"
+)
+
+/*
+	Solution streams: *solutionStream
+
+	A solution stream is produced by a goroutine, which computes the next
+	solution only when the consumer asks for it, so goals are executed in
+	strict order, and the consumer can stop the producer at any time, e.g. when
+	a cut is executed. All producers of a query also stop when the context of
+	the query is done.
+
+	An error raised by a producer stops it, and is raised again in the
+	goroutine of the consumer asking for the next solution.
+
+	A nil stream is an empty stream.
+*/
+
+type solutionStream struct {
+	// for streams with fixed solutions
+	static []*Bindings
+
+	req  chan struct{}
+	slns chan *Bindings // closed when the producer returned
+	done chan struct{}  // closed to stop the producer
+	// the error raised by the producer, set before slns is closed
+	err *PrologError
+
+	finished bool
+}
+
+// newStream starts a goroutine running produce. produce calls yield for each
+// solution, and should return as soon as yield returns false.
+func newStream(ctx context.Context, produce func(yield func(sln *Bindings) bool)) *solutionStream {
+	s := &solutionStream{
+		req:  make(chan struct{}),
+		slns: make(chan *Bindings),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(s.slns)
+		defer recoverError(&s.err)
+
+		select {
+		case <-s.req:
+		case <-s.done:
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		produce(func(sln *Bindings) bool {
+			select {
+			case s.slns <- sln:
+			case <-s.done:
+				return false
+			case <-ctx.Done():
+				return false
+			}
+
+			// wait for the consumer asking for the next one
+			select {
+			case <-s.req:
+				return true
+			case <-s.done:
+				return false
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+
+	return s
+}
+
+func makeSolutions(slns ...*Bindings) *solutionStream {
+	return &solutionStream{static: slns}
+}
+
+// next returns the next solution. ok is false if no more solutions.
+func (s *solutionStream) next() (sln *Bindings, ok bool) {
+	if s == nil || s.finished {
+		return nil, false
+	}
+
+	if s.req == nil {
+		if len(s.static) == 0 {
+			s.finished = true
+			return nil, false
+		}
+		sln, s.static = s.static[0], s.static[1:]
+		return sln, true
+	}
+
+	select {
+	case s.req <- struct{}{}:
+		sln, ok = <-s.slns
+	case <-s.slns:
+		// the producer has returned
+	}
+
+	if !ok {
+		s.finished = true
+		if s.err != nil {
+			panic(s.err)
+		}
+	}
+	return sln, ok
+}
+
+// pipe yields all the solutions in s. Returns false if yield returns false,
+// in which case s is closed.
+func (s *solutionStream) pipe(yield func(sln *Bindings) bool) bool {
+	for sln, ok := s.next(); ok; sln, ok = s.next() {
+		if !yield(sln) {
+			s.close()
+			return false
+		}
+	}
+	return true
+}
+
+// close stops the producer and waits until it returns. Remaining solutions,
+// and the error raised by the producer if any, are discarded.
+func (s *solutionStream) close() {
+	if s == nil || s.finished {
+		return
+	}
+	s.finished = true
+
+	if s.req == nil {
+		s.static = nil
+		return
+	}
+
+	close(s.done)
+	for _ = range s.slns {
+	}
+}
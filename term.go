@@ -4,14 +4,19 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/daviddengcn/go-villa"
-	//	"strconv"
-	//"strings"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync/atomic"
 )
 
 // Constants for Term.Type().
 const (
 	ttAtom    = iota // Atom, FirstLeft
 	ttInt            // Integer
+	ttFloat          // Float
+	ttBigInt         // BigInt
+	ttRational       // Rational
 	ttVar            // Variable
 	ttComplex        // *ComplexTerm
 	ttList           // List, HeadTail
@@ -20,6 +25,8 @@ const (
 
 type VarBindings interface {
 	get(v variable) variable
+	// returns the atom to put in the new term for at
+	atom(at atom) atom
 }
 
 type Term interface {
@@ -51,36 +58,95 @@ func TermFromString(s string) Term {
 	return A(s)
 }
 
-func term(t interface{}) Term {
-	switch vl := t.(type) {
+// NewTerm converts the Go value v to a term, as the term builders, e.g. CT
+// and L, do to their arguments: a Go number to a number, a string by
+// TermFromString, and a Term as it is. The *PrologError of type_error(term,
+// Type) is returned if v cannot be converted, where Type is its Go type.
+func NewTerm(v interface{}) (Term, error) {
+	switch vl := v.(type) {
 	case int:
-		return Integer(vl)
+		return Integer(vl), nil
 	case int32:
-		return Integer(vl)
+		return Integer(vl), nil
 	case int64:
-		return Integer(vl)
+		return Integer(vl), nil
+	case float64:
+		return Float(vl), nil
+	case float32:
+		return Float(vl), nil
+	case *big.Int:
+		return Big(vl), nil
+	case *big.Rat:
+		return Rat(vl), nil
 
 	case string:
-		return TermFromString(vl)
+		return TermFromString(vl), nil
 
 	case Term:
-		return vl
+		return vl, nil
 	}
-	panic(fmt.Sprintf("Invalid argument %v for CT", t))
+	return nil, typeError("term", A(fmt.Sprintf("%T", v)), nil)
 }
 
-/* Atom term: Atom */
+func term(t interface{}) Term {
+	tm, err := NewTerm(t)
+	if err != nil {
+		return invalidTerm{err: err.(*PrologError)}
+	}
+	return tm
+}
 
-type atom int
+/*
+	Invalid term: invalidTerm
 
-func A(name string) atom {
-	return atom(gAtomPool.indexOfName(name))
+	A Go value which cannot be converted by the term builders is kept as an
+	invalidTerm, whose error is raised when a query or a clause with it is
+	used, i.e. returned by Query.Err or AddRule.
+*/
+
+type invalidTerm struct {
+	err *PrologError
+}
+
+func (it invalidTerm) Type() int {
+	return ttAtom
 }
 
-var gAtomPool = newNamePool()
+func (it invalidTerm) replaceVars(bds VarBindings) Term {
+	panic(it.err)
+}
+
+func (it invalidTerm) Match(R Term, bds *Bindings) bool {
+	panic(it.err)
+}
+
+func (it invalidTerm) unify(bds *Bindings) Term {
+	panic(it.err)
+}
+
+func (it invalidTerm) export(bds *Bindings) Term {
+	panic(it.err)
+}
+
+func (it invalidTerm) String() string {
+	return fmt.Sprintf("<%v>", it.err)
+}
+
+/*
+	Atom term: Atom
+
+	An atom is its name. The atoms of clauses are interned in the atom table of
+	their Machine, others are released with the terms referencing them.
+*/
+
+type atom string
+
+func A(name string) atom {
+	return atom(name)
+}
 
 func (at atom) String() string {
-	return gAtomPool.nameOfIndex(int(at))
+	return string(at)
 }
 
 func (at atom) Type() int {
@@ -88,7 +154,7 @@ func (at atom) Type() int {
 }
 
 func (at atom) replaceVars(bds VarBindings) Term {
-	return at
+	return bds.atom(at)
 }
 
 func (l atom) Match(R Term, bds *Bindings) bool {
@@ -143,59 +209,202 @@ func (i Integer) export(bds *Bindings) Term {
 	return i
 }
 
-/* Variable term: Variable */
+/* Big integer numbers: BigInt */
+
+// BigInt is an integer out of the range of Integer. An integer in the range is
+// always an Integer.
+type BigInt struct {
+	// never modified
+	i *big.Int
+}
+
+// Big returns i as an integer term, which is an Integer if i is in its range.
+// i should not be modified afterwards.
+func Big(i *big.Int) Term {
+	if i.IsInt64() {
+		if v := i.Int64(); int64(Integer(v)) == v {
+			return Integer(v)
+		}
+	}
+	return BigInt{i: i}
+}
+
+func (b BigInt) String() string {
+	return b.i.String()
+}
+
+func (b BigInt) Type() int {
+	return ttBigInt
+}
 
-var gVarPool = newNamePool()
+func (b BigInt) replaceVars(bds VarBindings) Term {
+	return b
+}
 
-type variable int
+func (l BigInt) Match(R Term, bds *Bindings) bool {
+	r, ok := R.(BigInt)
+	return ok && l.i.Cmp(r.i) == 0
+}
+
+func (b BigInt) unify(bds *Bindings) Term {
+	return b
+}
+
+func (b BigInt) export(bds *Bindings) Term {
+	return b
+}
+
+/* Rational numbers: Rational */
+
+// Rational is a rational number which is not an integer, printed as NrD, e.g.
+// 1r3. Its denominator is always positive, and coprime to its numerator.
+type Rational struct {
+	// never modified
+	r *big.Rat
+}
+
+// Rat returns r as a number term, which is an integer if the denominator of r
+// is 1. r should not be modified afterwards.
+func Rat(r *big.Rat) Term {
+	if r.IsInt() {
+		return Big(r.Num())
+	}
+	return Rational{r: r}
+}
+
+func (r Rational) String() string {
+	return r.r.Num().String() + "r" + r.r.Denom().String()
+}
+
+func (r Rational) Type() int {
+	return ttRational
+}
+
+func (r Rational) replaceVars(bds VarBindings) Term {
+	return r
+}
+
+func (l Rational) Match(R Term, bds *Bindings) bool {
+	r, ok := R.(Rational)
+	return ok && l.r.Cmp(r.r) == 0
+}
+
+func (r Rational) unify(bds *Bindings) Term {
+	return r
+}
+
+func (r Rational) export(bds *Bindings) Term {
+	return r
+}
+
+/* Floating point numbers: Float */
+
+type Float float64
+
+func (f Float) String() string {
+	s := strconv.FormatFloat(float64(f), 'g', -1, 64)
+	mant, exp, hasExp := strings.Cut(s, "e")
+	if !strings.ContainsAny(mant, ".NI") {
+		// always with a dot, e.g. 1.0 or 1.0e10
+		mant += ".0"
+	}
+	if !hasExp {
+		return mant
+	}
+
+	sign := ""
+	if exp[0] == '-' {
+		sign = "-"
+	}
+	return mant + "e" + sign + strings.TrimLeft(exp[1:], "0")
+}
+
+func (f Float) Type() int {
+	return ttFloat
+}
+
+func (f Float) replaceVars(bds VarBindings) Term {
+	return f
+}
+
+func (l Float) Match(R Term, bds *Bindings) bool {
+	r, ok := R.(Float)
+	return ok && l == r
+}
+
+func (f Float) unify(bds *Bindings) Term {
+	return f
+}
+
+func (f Float) export(bds *Bindings) Term {
+	return f
+}
+
+/*
+	Variable term: Variable
+
+	A named variable is identified by its name. Other variables, i.e. g/p/r-variables, are identified by negative ids.
+*/
+
+type variable struct {
+	// the name of a named variable
+	name string
+	// 0 for a named variable
+	id int
+}
 
 func V(name string) variable {
-	return variable(gVarPool.indexOfName(name))
+	return variable{name: name}
+}
+
+// whether v is a named variable
+func (v variable) isNamed() bool {
+	return v.id == 0
 }
 
 // gIndex -> variable
 func gV(gIndex int) variable {
-	return variable(-(gIndex + 1) * 4)
+	return variable{id: -(gIndex + 1) * 4}
 }
 
 // variable -> gIndex
 func (v variable) gIndex() int {
-	return (-int(v))/4 - 1
+	return (-v.id)/4 - 1
 }
 
 // whether v is a g-variable
 func (v variable) isG() bool {
-	return v < 0 && (-int(v))%4 == 0
+	return v.id < 0 && (-v.id)%4 == 0
 }
 
 // pIndex -> variable
 func pV(pIndex int) variable {
-	return variable(-(pIndex*4 + 1))
+	return variable{id: -(pIndex*4 + 1)}
 }
 
 // variable -> pIndex
 func (v variable) pIndex() int {
-	return (-int(v)) / 4
+	return (-v.id) / 4
 }
 
 // whether v is a p-variable
 func (v variable) isP() bool {
-	return v < 0 && (-int(v))%4 == 1
+	return v.id < 0 && (-v.id)%4 == 1
 }
 
 // rIndex -> variable
 func rV(rIndex int) variable {
-	return variable(-(rIndex*4 + 2))
+	return variable{id: -(rIndex*4 + 2)}
 }
 
 // variable -> rIndex
 func (v variable) rIndex() int {
-	return (-int(v)) / 4
+	return (-v.id) / 4
 }
 
 // whether v is a r-variable
 func (v variable) isR() bool {
-	return v < 0 && (-int(v))%4 == 2
+	return v.id < 0 && (-v.id)%4 == 2
 }
 
 func (v variable) Type() int {
@@ -203,8 +412,8 @@ func (v variable) Type() int {
 }
 
 func (v variable) String() string {
-	if v >= 0 {
-		return gVarPool.nameOfIndex(int(v))
+	if v.isNamed() {
+		return v.name
 	}
 
 	if v.isG() {
@@ -219,7 +428,7 @@ func (v variable) String() string {
 		return fmt.Sprintf("R_%d", v.rIndex())
 	}
 
-	return fmt.Sprint("Invalid_%d", -v)
+	return fmt.Sprintf("Invalid_%d", -v.id)
 }
 
 func (v variable) replaceVars(bds VarBindings) Term {
@@ -231,9 +440,7 @@ func (l variable) Match(R Term, bds *Bindings) bool {
 		// both Variable's
 		r := R.(variable)
 		if l != r {
-			s := genUniqueVar()
-			bds.Put(l, s)
-			bds.Put(r, s)
+			bds.Put(l, r)
 			// Otherwise already matche
 		}
 	} else {
@@ -259,7 +466,8 @@ func (v variable) export(bds *Bindings) Term {
 	}
 
 	vl := t.(variable)
-	if vl.isR() {
+	if vl.isP() {
+		// p-variables are local to the proving, export a new one
 		s := genUniqueVar()
 		bds.Put(vl, s)
 		return s
@@ -267,21 +475,11 @@ func (v variable) export(bds *Bindings) Term {
 	return t
 }
 
-var gUniqueVarChan chan variable
-
-func init() {
-	gUniqueVarChan = make(chan variable, 10)
-	go func() {
-		counter := 0
-		for {
-			gUniqueVarChan <- gV(counter)
-			counter++
-		}
-	}()
-}
+// number of g-variables generated
+var gUniqueVarCount atomic.Int64
 
 func genUniqueVar() variable {
-	return <-gUniqueVarChan
+	return gV(int(gUniqueVarCount.Add(1) - 1))
 }
 
 /* Complex term: *ComplexTerm */
@@ -306,16 +504,22 @@ func (ct *ComplexTerm) Type() int {
 }
 
 func (ct *ComplexTerm) replaceVars(bds VarBindings) Term {
-	newCt := &ComplexTerm{Functor: ct.Functor, Args: make([]Term, len(ct.Args))}
+	newCt := &ComplexTerm{Functor: bds.atom(ct.Functor), Args: make([]Term, len(ct.Args))}
 	for i, arg := range ct.Args {
 		newCt.Args[i] = arg.replaceVars(bds)
 	}
 	return newCt
 }
 
-func (ct *ComplexTerm) Key() int {
+// predKey identifies a predicate by its name and arity.
+type predKey struct {
+	functor atom
+	arity   int
+}
+
+func (ct *ComplexTerm) Key() predKey {
 	//return fmt.Sprintf("%s/%d", ct.Functor, len(ct.Args))
-	return int(ct.Functor)*1024 | len(ct.Args)
+	return predKey{functor: ct.Functor, arity: len(ct.Args)}
 }
 
 func (ct *ComplexTerm) String() string {
@@ -592,8 +796,9 @@ const (
 	opGt = iota // >
 	opGe        // >=
 	opLt        // <
-	opLe        // <=
-	opNe        // !=
+	opLe        // =<
+	opNe        // =\=
+	opEq        // =:=
 
 	opIs // is
 
@@ -607,8 +812,9 @@ var OpNames map[int]string = map[int]string{
 	opGt: ">",
 	opGe: ">=",
 	opLt: "<",
-	opLe: "<=",
-	opNe: "!=",
+	opLe: "=<",
+	opNe: "=\\=",
+	opEq: "=:=",
 
 	opIs: "is",
 
@@ -625,45 +831,70 @@ type buildin2 struct {
 	L, R Term
 }
 
-func Op(l, op, r interface{}) *buildin2 {
-	res := buildin2{L: term(l), R: term(r)}
-	switch op.(string) {
+// opOfName returns the buildin operator of the ISO name, e.g. =<.
+func opOfName(name string) (op int, ok bool) {
+	switch name {
 	case ">":
-		res.Op = opGt
+		return opGt, true
 
-	case ">=", "=>":
-		res.Op = opGe
+	case ">=":
+		return opGe, true
 
 	case "<":
-		res.Op = opLt
+		return opLt, true
+
+	case "=<":
+		return opLe, true
 
-	case "<=", "=<":
-		res.Op = opLe
+	case "=\\=":
+		return opNe, true
 
-	case "=\\=", "!=":
-		res.Op = opNe
+	case "=:=":
+		return opEq, true
 
 	case "+":
-		res.Op = opPlus
+		return opPlus, true
 	case "-":
-		res.Op = opMinus
+		return opMinus, true
 	case "*":
-		res.Op = opMul
+		return opMul, true
 	case "/":
-		res.Op = opDiv
+		return opDiv, true
 
 	case "is":
-		res.Op = opIs
-
-	default:
-		panic(fmt.Sprintf("Unknown op-string: %s", op))
+		return opIs, true
 	}
 
-	return &res
+	return 0, false
+}
+
+// opAliases maps other names of buildin operators accepted by Op to their ISO
+// names. They are ordinary atoms in Prolog text.
+var opAliases = map[string]string{
+	"=>": ">=",
+	"<=": "=<",
+	"!=": "=\\=",
+}
+
+// callable is a term which can also be proved as a goal, i.e. a *buildin2 or
+// a *ComplexTerm.
+type callable interface {
+	Term
+	Goal
+}
+
+// Op creates the term l op r. If op is not a builtin operator, the term is a
+// *ComplexTerm op(l, r).
+func Op(l, op, r interface{}) callable {
+	name := fmt.Sprint(op)
+	if iso, ok := opAliases[name]; ok {
+		name = iso
+	}
+	return compound(name, term(l), term(r)).(callable)
 }
 
 func Is(l, r interface{}) *buildin2 {
-	return Op(l, "is", r)
+	return &buildin2{Op: opIs, L: term(l), R: term(r)}
 }
 
 func (bi *buildin2) String() string {
@@ -704,49 +935,6 @@ func (bi *buildin2) export(bds *Bindings) Term {
 		L: bi.L.export(bds), R: bi.R.export(bds)}
 }
 
-func isNumber(T Term) bool {
-	return T.Type() == ttInt
-}
-
-func (bi *buildin2) compute() Term {
-	L := bi.L
-	if !isNumber(L) {
-		L = computeTerm(L)
-		if L == nil {
-			return nil
-		}
-	}
-
-	R := bi.R
-	if !isNumber(R) {
-		R = computeTerm(R)
-		if R == nil {
-			return nil
-		}
-	}
-
-	if L.Type() == ttInt && R.Type() == ttInt {
-		l, r := L.(Integer), R.(Integer)
-		var res Integer
-		switch bi.Op {
-		case opPlus:
-			res = l + r
-		case opMinus:
-			res = l - r
-		case opMul:
-			res = l * r
-		case opDiv:
-			res = l / r
-		default:
-			return nil
-		}
-
-		return res
-	}
-
-	return nil
-}
-
 /* pVarBindings: gV/rV -> pV */
 type pVarBindings struct {
 	rList []*variable
@@ -799,6 +987,10 @@ func (bds *pVarBindings) String() string {
 	return buf.String()
 }
 
+func (bds *pVarBindings) atom(at atom) atom {
+	return at
+}
+
 func (bds *pVarBindings) get(v variable) (newV variable) {
 	if v.isR() {
 		pv := bds.rList[v.rIndex()]
@@ -827,18 +1019,6 @@ func (bds *pVarBindings) get(v variable) (newV variable) {
 	return newV
 }
 
-func (bds *pVarBindings) each(callback func(v, vl variable)) {
-	for i, vl := range bds.rList {
-		if vl != nil {
-			callback(rV(i), *vl)
-		}
-	}
-
-	for v, vl := range bds.gMap {
-		callback(v, vl)
-	}
-}
-
 func newPVarBindings(nRVars int) *pVarBindings {
 	return &pVarBindings{rList: make([]*variable, nRVars)}
 }
@@ -846,6 +1026,10 @@ func newPVarBindings(nRVars int) *pVarBindings {
 /* rVarBindings: gV -> rV */
 type rVarBindings map[variable]variable
 
+func (bds rVarBindings) atom(at atom) atom {
+	return at
+}
+
 func (bds rVarBindings) get(v variable) variable {
 	newV, ok := bds[v]
 	if ok {
@@ -857,38 +1041,47 @@ func (bds rVarBindings) get(v variable) variable {
 	return newV
 }
 
-/* Bindings: Variable map to its value as a Term */
+/*
+	Bindings: Variable map to its value as a Term
+
+	When proving a goal, all variables are localized to p-variables, which are
+	bound destructively in a single Bindings. If trailing, the bound variables
+	are recorded, so that backtracking simply undoes them back to a mark.
+*/
 
 type Bindings struct {
-	nRVars int
-	rList []Term
+	// values of p-variables, indexed by pIndex, nil for unbound
+	pList []Term
+	// values of other variables
 	gMap map[variable]Term
-	
-	parent *Bindings
+
+	// if trailing, all Puts are recorded in trail
+	trailing bool
+	trail    []variable
 }
 
-func newBindings(parent *Bindings, nRVars int) *Bindings {
-	return &Bindings{nRVars: nRVars, parent: parent}
+// bdsMark is a state of a trailing Bindings to undo to.
+type bdsMark struct {
+	trail int // length of the trail
+	vars  int // number of p-variables
 }
 
-func newBindingsFrom(parent *Bindings) *Bindings {
-	return &Bindings{nRVars: parent.RVarCount(), parent: parent}
+func newBindings() *Bindings {
+	return &Bindings{}
+}
+
+// newTrailBindings returns a Bindings with nPVars unbound p-variables, which
+// records all Puts for undo.
+func newTrailBindings(nPVars int) *Bindings {
+	return &Bindings{pList: make([]Term, nPVars), trailing: true}
 }
 
 func (bds *Bindings) String() string {
 	var buf bytes.Buffer
 	buf.WriteRune('[')
 	first := true
-	if bds.parent != nil {
-		if first {
-			first = false
-		} else {
-			buf.WriteRune(' ')
-		}
-		buf.WriteString(bds.parent.String())
-	}
 	if bds != nil {
-		for i, vl := range bds.rList {
+		for i, vl := range bds.pList {
 			if vl == nil {
 				continue
 			}
@@ -898,7 +1091,7 @@ func (bds *Bindings) String() string {
 				buf.WriteRune(' ')
 			}
 
-			buf.WriteString(fmt.Sprintf("%v->%v", rV(i), vl))
+			buf.WriteString(fmt.Sprintf("%v->%v", pV(i), vl))
 		}
 
 		keys := make([]variable, 0, len(bds.gMap))
@@ -929,25 +1122,19 @@ func (bds *Bindings) String() string {
 }
 
 func (bds *Bindings) Put(v variable, t Term) {
-	if v.isR() {
-		idx := v.rIndex()
-		if bds.rList == nil {
-			if idx >= bds.nRVars {
-				panic(fmt.Sprintf("Index %d is out of range(< %d)!", idx, bds.nRVars))
-			}
-			bds.rList = make([]Term, bds.nRVars)
-		}
-		bds.rList[idx] = t
-		return
+	if bds.trailing {
+		bds.trail = append(bds.trail, v)
 	}
 
-	if bds.gMap == nil {
-		bds.gMap = make(map[variable]Term)
+	if v.isP() {
+		idx := v.pIndex()
+		if idx >= len(bds.pList) {
+			bds.pList = append(bds.pList, make([]Term, idx+1-len(bds.pList))...)
+		}
+		bds.pList[idx] = t
+		return
 	}
-	bds.gMap[v] = t
-}
 
-func (bds *Bindings) _putG(v variable, t Term) {
 	if bds.gMap == nil {
 		bds.gMap = make(map[variable]Term)
 	}
@@ -960,31 +1147,48 @@ func (bds *Bindings) Get(v variable) (t Term) {
 		return nil
 	}
 
-	if v.isR() {
-		idx := v.rIndex()
-		if bds.rList == nil {
-			if idx >= bds.nRVars {
-				panic(fmt.Sprintf("Index %d is out of range(< %d)!", idx, bds.nRVars))
-			}
-		} else {
-		 t = bds.rList[idx]
+	if v.isP() {
+		if idx := v.pIndex(); idx < len(bds.pList) {
+			return bds.pList[idx]
 		}
-	} else {
-		t = bds.gMap[v]
+		return nil
 	}
 
-	if t == nil {
-		t = bds.parent.Get(v)
+	return bds.gMap[v]
+}
+
+// newVars allocates n unbound p-variables, returns the pIndex of the first one.
+func (bds *Bindings) newVars(n int) (base int) {
+	base = len(bds.pList)
+	for i := 0; i < n; i++ {
+		bds.pList = append(bds.pList, nil)
 	}
-	
-	return t
+	return base
 }
 
-func (bds *Bindings) RVarCount() int {
-	if bds == nil {
-		return 0
+// mark returns the current state for undo.
+func (bds *Bindings) mark() bdsMark {
+	return bdsMark{trail: len(bds.trail), vars: len(bds.pList)}
+}
+
+// undo removes the bindings put and the p-variables allocated after mk.
+func (bds *Bindings) undo(mk bdsMark) {
+	for i := len(bds.trail) - 1; i >= mk.trail; i-- {
+		v := bds.trail[i]
+		if v.isP() {
+			if idx := v.pIndex(); idx < len(bds.pList) {
+				bds.pList[idx] = nil
+			}
+		} else {
+			delete(bds.gMap, v)
+		}
+	}
+	bds.trail = bds.trail[:mk.trail]
+
+	for i := mk.vars; i < len(bds.pList); i++ {
+		bds.pList[i] = nil
 	}
-	return bds.nRVars
+	bds.pList = bds.pList[:mk.vars]
 }
 
 // keep unify until t is no longer a Variable, but no further unify
@@ -1000,13 +1204,19 @@ func (bds *Bindings) unifyVar(t Term) Term {
 	return t
 }
 
-// a -> a(+b)
-func (a *Bindings) cat(b *Bindings) {
-	for a.parent != nil {
-		a = a.parent
+/* pVarOffset: rV -> pV, renaming variables of a rule for a call */
+
+type pVarOffset int
+
+func (off pVarOffset) atom(at atom) atom {
+	return at
+}
+
+func (off pVarOffset) get(v variable) variable {
+	if v.isR() {
+		return pV(int(off) + v.rIndex())
 	}
-	
-	a.parent = b
+	return v
 }
 
 /* matchTerm */
@@ -1033,16 +1243,3 @@ func matchTerm(L, R Term, bds *Bindings) (succ bool) {
 
 	return R.Match(L, bds)
 }
-
-/* computeTerm */
-
-func computeTerm(T Term) Term {
-	switch T.Type() {
-	case ttInt:
-		return T
-	case ttBuildin:
-		t := T.(*buildin2)
-		return t.compute()
-	}
-	return nil
-}